@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/http-proxy/proxy"
+)
+
+// adminHandler serves the admin API, for operating the proxy at runtime.
+//
+//	GET  /                     HTML dashboard of hosts and their requests
+//	GET  /hosts                list configured hosts, and whether they're enabled
+//	POST /hosts/{host}/disable respond 503 to requests for host, with
+//	                           ?retry-after=seconds, 60 by default
+//	POST /hosts/{host}/enable  serve requests for host again
+//	POST /hosts/{host}/canary  send ?percent=n of host's requests to its canary
+//	POST /reload-certs         reload the TLS certificate and key
+//	GET  /version              the version, commit, and build date
+//
+// Changes to hosts last until the config is reloaded. Certs is nil unless TLS
+// is served from -cert and -key. Cross-origin POSTs from browsers are
+// rejected, so a page the operator visits can't disable hosts behind their
+// back.
+func adminHandler(handler *proxy.Handler, certs *certificate) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		var (
+			cfg      = handler.Configuration()
+			disabled = handler.Disabled()
+			requests = handler.Requests()
+			page     = dashboardPage{Version: versionString(), Loaded: handler.Loaded().UTC().Format(time.RFC3339)}
+		)
+		for host, target := range cfg {
+			status := "enabled"
+			if retryAfter, ok := disabled[host]; ok {
+				status = fmt.Sprintf("disabled (retry after %s)", retryAfter)
+			}
+			page.Hosts = append(page.Hosts, dashboardHost{
+				Host:     host,
+				Dest:     target.Dest,
+				Status:   status,
+				Disabled: status != "enabled",
+				Requests: requests[host],
+			})
+		}
+		sort.Slice(page.Hosts, func(i, j int) bool { return page.Hosts[i].Host < page.Hosts[j].Host })
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboard.Execute(w, page); err != nil {
+			log.Printf("admin dashboard: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /hosts", func(w http.ResponseWriter, r *http.Request) {
+		var (
+			cfg      = handler.Configuration()
+			disabled = handler.Disabled()
+			hosts    []string
+		)
+		for host := range cfg {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+		for _, host := range hosts {
+			status := "enabled"
+			if retryAfter, ok := disabled[host]; ok {
+				status = fmt.Sprintf("disabled (retry after %s)", retryAfter)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", host, cfg[host].Dest, status)
+		}
+		tw.Flush()
+	})
+	mux.HandleFunc("POST /hosts/{host}/disable", func(w http.ResponseWriter, r *http.Request) {
+		retryAfter := 60 * time.Second
+		if s := r.URL.Query().Get("retry-after"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid retry-after, want seconds", http.StatusBadRequest)
+				return
+			}
+			retryAfter = time.Duration(n) * time.Second
+		}
+		host := r.PathValue("host")
+		if err := handler.Disable(host, retryAfter); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logAdmin(r, "disabled %s", host)
+		fmt.Fprintf(w, "%s disabled\n", host)
+	})
+	mux.HandleFunc("POST /hosts/{host}/enable", func(w http.ResponseWriter, r *http.Request) {
+		host := r.PathValue("host")
+		if err := handler.Enable(host); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logAdmin(r, "enabled %s", host)
+		fmt.Fprintf(w, "%s enabled\n", host)
+	})
+	mux.HandleFunc("POST /hosts/{host}/canary", func(w http.ResponseWriter, r *http.Request) {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(r.URL.Query().Get("percent"), "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			http.Error(w, "invalid percent, want 0 to 100", http.StatusBadRequest)
+			return
+		}
+		host := r.PathValue("host")
+		if err := handler.SetCanary(host, percent); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logAdmin(r, "set %s canary to %v%%", host, percent)
+		fmt.Fprintf(w, "%s canary at %v%%\n", host, percent)
+	})
+	mux.HandleFunc("POST /reload-certs", func(w http.ResponseWriter, r *http.Request) {
+		if certs == nil {
+			http.Error(w, "not serving TLS from -cert and -key", http.StatusNotFound)
+			return
+		}
+		keypair, err := certs.reload()
+		if err != nil {
+			logAdmin(r, "bad TLS certificate, keeping previous one (%v)", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		expires := keypair.Leaf.NotAfter.UTC().Format(time.RFC3339)
+		logAdmin(r, "reloaded TLS certificate, expires %s", expires)
+		fmt.Fprintf(w, "reloaded certificate, expires %s\n", expires)
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n", versionString())
+	})
+	return http.NewCrossOriginProtection().Handler(mux)
+}
+
+type dashboardPage struct {
+	Version string
+	Loaded  string
+	Hosts   []dashboardHost
+}
+
+type dashboardHost struct {
+	Host     string
+	Dest     string
+	Status   string
+	Disabled bool
+	Requests proxy.RequestCounts
+}
+
+// dashboard is the admin API's HTML page, refreshed every 10 seconds.
+var dashboard = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>http-proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; }
+.disabled { color: #b00; }
+</style>
+</head>
+<body>
+<h1>http-proxy</h1>
+<p>Version {{.Version}}. Config loaded {{.Loaded}}.</p>
+<table>
+<tr><th>Host</th><th>Destination</th><th>Status</th><th>Requests</th><th>5xx</th></tr>
+{{range .Hosts}}<tr>
+<td>{{.Host}}</td>
+<td>{{.Dest}}</td>
+<td{{if .Disabled}} class="disabled"{{end}}>{{.Status}}</td>
+<td class="n">{{.Requests.Total}}</td>
+<td class="n">{{.Requests.Errors}}</td>
+</tr>
+{{else}}<tr><td colspan="5">No hosts configured.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// logAdmin logs an action taken via the admin API.
+func logAdmin(r *http.Request, format string, args ...interface{}) {
+	log.Printf("admin %s: "+format, append([]interface{}{r.RemoteAddr}, args...)...)
+}
+
+// isLoopback reports whether the listen address only accepts connections
+// from the local machine.
+func isLoopback(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// certificate is the TLS certificate served from -cert and -key, or their
+// inline PEM. It can be reloaded while it's in use.
+type certificate struct {
+	load    func() (tls.Certificate, error)
+	current atomic.Pointer[tls.Certificate]
+}
+
+// reload loads the certificate again and, if it's valid, serves it from now
+// on. Otherwise, the previous certificate is still served.
+func (c *certificate) reload() (*tls.Certificate, error) {
+	cert, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, errors.Wrap(err, "parsing certificate")
+		}
+	}
+	c.current.Store(&cert)
+	return &cert, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
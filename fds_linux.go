@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// defaultFDWarn is the default -fd-warn.
+const defaultFDWarn = 0.8
+
+// openFiles returns the number of file descriptors the process has open, and
+// the soft limit on them.
+func openFiles() (n int, limit uint64, err error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+	f, err := os.Open("/proc/self/fd")
+	if errors.Is(err, syscall.EMFILE) {
+		return int(rlimit.Cur), rlimit.Cur, nil // none left to count them with
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(names) - 1, rlimit.Cur, nil // not counting f
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// defaultFDWarn is the default -fd-warn: off, as open files can't be counted.
+const defaultFDWarn = 0
+
+func openFiles() (n int, limit uint64, err error) {
+	return 0, 0, errors.New("counting open files is only supported on Linux")
+}
@@ -1,8 +1,15 @@
 module github.com/peterbourgon/http-proxy
 
-go 1.14
+go 1.26.0
 
 require (
 	github.com/oklog/run v1.1.0
 	github.com/pkg/errors v0.9.1
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+)
+
+require (
+	golang.org/x/net v0.58.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
 )
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listenOptions tune the listeners. Go already sets SO_REUSEADDR on TCP
+// listeners, and TCP_NODELAY on accepted connections, by default.
+type listenOptions struct {
+	backlog   int        // 0 means the system default
+	reusePort bool       // TCP only
+	noDelay   bool       // TCP only
+	perIP     *ipLimiter // TCP only, nil means no limit
+}
+
+// listen listens on addr, which is either a TCP address, or unix:path for a
+// Unix socket. A stale socket file at path, which nothing is listening on, is
+// removed first; the socket file is removed again when the listener is closed.
+func listen(addr string, opts listenOptions) (net.Listener, error) {
+	network, address := "tcp", addr
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		network, address = "unix", path
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var lc net.ListenConfig
+	if opts.reusePort && network == "tcp" {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			return control(c, setReusePort)
+		}
+	}
+	ln, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.backlog > 0 {
+		sc, ok := ln.(syscall.Conn)
+		if !ok {
+			ln.Close()
+			return nil, errors.Errorf("%s: can't set backlog", addr)
+		}
+		c, err := sc.SyscallConn()
+		if err == nil {
+			err = control(c, func(fd uintptr) error { return setBacklog(fd, opts.backlog) })
+		}
+		if err != nil {
+			ln.Close()
+			return nil, errors.Wrap(err, "setting backlog")
+		}
+	}
+
+	if !opts.noDelay && network == "tcp" {
+		ln = delayListener{ln}
+	}
+
+	if opts.perIP != nil && network == "tcp" {
+		ln = &limitListener{Listener: ln, limiter: opts.perIP}
+	}
+
+	return ln, nil
+}
+
+// control calls f with the file descriptor of c, and returns its error.
+func control(c syscall.RawConn, f func(fd uintptr) error) error {
+	var ferr error
+	if err := c.Control(func(fd uintptr) { ferr = f(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// delayListener disables TCP_NODELAY on accepted connections.
+type delayListener struct {
+	net.Listener
+}
+
+func (l delayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(false)
+	}
+	return conn, err
+}
+
+// ipLimiter counts the open connections from each client IP, across every
+// listener it's used by, and refuses those over the limit.
+type ipLimiter struct {
+	limit int
+
+	mtx      sync.Mutex
+	conns    map[string]int
+	refusing map[string]bool // logged as over the limit
+}
+
+func newIPLimiter(limit int) *ipLimiter {
+	return &ipLimiter{
+		limit:    limit,
+		conns:    map[string]int{},
+		refusing: map[string]bool{},
+	}
+}
+
+// acquire counts a new connection from ip, and reports whether it's within the
+// limit. If it is, release must be called when it's closed.
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.conns[ip] >= l.limit {
+		if !l.refusing[ip] {
+			log.Printf("refusing connections from %s, which has %d open (-max-conns-per-ip)", ip, l.conns[ip])
+			l.refusing[ip] = true
+		}
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+	delete(l.refusing, ip)
+}
+
+// removeStaleSocket removes the socket file at path if connecting to it is
+// refused, as nothing is listening on it. If something is, e.g. another
+// instance started by mistake, it's left alone, and an error returned.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil // listening reports any problem with the path
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return errors.Errorf("%s: address already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.Wrap(err, "checking for a stale socket")
+	}
+	return errors.Wrap(os.Remove(path), "removing stale socket")
+}
+
+// limitListener closes accepted connections from client IPs that already have
+// as many open as the limiter allows.
+type limitListener struct {
+	net.Listener
+	limiter *ipLimiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil
+		}
+		if !l.limiter.acquire(ip) {
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: func() { l.limiter.release(ip) }}, nil
+	}
+}
+
+// limitConn releases its count with the limiter when it's closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// ReadFrom lets net/http reach the TCP connection's ReadFrom, which sends
+// files with sendfile.
+func (c *limitConn) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(c.Conn, r)
+}
+
+// readFrom copies r to conn, with conn's ReadFrom if it has one.
+func readFrom(conn net.Conn, r io.Reader) (int64, error) {
+	if rf, ok := conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{conn}, r)
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
@@ -21,23 +25,92 @@ import (
 
 	"github.com/oklog/run"
 	"github.com/pkg/errors"
-)
+	"golang.org/x/crypto/acme/autocert"
 
-var version = "dev"
+	"github.com/peterbourgon/http-proxy/proxy"
+)
 
 func main() {
 	fs := flag.NewFlagSet("http-proxy", flag.ExitOnError)
 	var (
-		httpAddr = fs.String("http", ":80", "serve HTTP on this address (optional)")
-		tlsAddr  = fs.String("tls", "", "serve TLS on this address (optional)")
+		httpAddr = fs.String("http", ":80", "serve HTTP on this address or unix:path (optional)")
+		tlsAddr  = fs.String("tls", "", "serve TLS on this address or unix:path (optional)")
 		cert     = fs.String("cert", "server.crt", "TLS certificate")
 		key      = fs.String("key", "server.key", "TLS key")
-		config   = fs.String("config", "proxy.conf", "config file")
+		chain    = fs.String("chain", "", "TLS intermediate certificates, appended to the certificate (optional)")
+		certPEM  = fs.String("cert-pem", "", "TLS certificate as PEM, overrides -cert (env PROXY_CERT_PEM)")
+		keyPEM   = fs.String("key-pem", "", "TLS key as PEM, overrides -key (env PROXY_KEY_PEM)")
+		backlog  = fs.Int("backlog", 0, "listen backlog, capped by the kernel, or 0 for the system default")
+		reuse    = fs.Bool("reuseport", false, "set SO_REUSEPORT on TCP listeners")
+		procs    = fs.Int("gomaxprocs", 0, "max CPUs to use, or 0 for the Go default, which respects container CPU limits")
+		perIP    = fs.Int("max-conns-per-ip", 0, "refuse new connections from client IPs with this many open, or 0 for no limit")
+		noDelay  = fs.Bool("tcp-nodelay", true, "set TCP_NODELAY on accepted connections")
+		maxHdr   = fs.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "reject requests with larger headers with 431")
+		maxResp  = fs.Int64("max-response-header-bytes", 10<<20, "fail backend responses with larger headers with 502")
+		dbgHdrs  = fs.Bool("debug-headers", false, "log request and response headers exchanged with backends")
+		redact   = fs.String("debug-redact", "Authorization,Cookie,Proxy-Authorization,Set-Cookie", "header values to redact with -debug-headers")
+		sample   = fs.Float64("log-sample", 1.0, "fraction of successful requests to log, errors are always logged")
+		logTLS   = fs.Bool("log-tls", false, "log the TLS version and cipher suite of TLS requests")
+		fwdSNI   = fs.Bool("forward-sni", false, "send the TLS server name requested by clients to backends in X-Forwarded-SNI, and log it")
+		logRule  = fs.Bool("log-rule", false, "log the config rule, host or host/prefix, that matched each request")
+		ruleHdr  = fs.String("rule-header", "", "send the config rule that matched each request in this response header, e.g. X-Proxy-Rule (optional)")
+		noHost   = fs.String("empty-host", "", "serve requests without a Host header as this host, or 400 to reject them; by default they're unmatched (optional)")
+		unmatch  = fs.String("unmatched", "404", "response for unconfigured hosts: 404, close, or a status code")
+		acmeDir  = fs.String("acme", "", "obtain TLS certificates via ACME, cached in this directory (optional)")
+		acmeMail = fs.String("acme-email", "", "contact email for the ACME account (optional)")
+		resolver = fs.String("resolver", "", "resolve backend hostnames with this DNS server, host:port (optional)")
+		dnsTTL   = fs.Duration("dns-ttl", 0, "cache backend DNS results for this long (optional)")
+		dirCheck = fs.Duration("dir-check-interval", 10*time.Second, "check file server directories are available this often, or 0 to disable")
+		drain    = fs.Duration("drain-delay", 0, "on SIGINT or SIGTERM, keep serving with keep-alives disabled for this long before shutting down (optional)")
+		shutTO   = fs.Duration("shutdown-timeout", time.Second, "on shutdown, wait this long for in-flight requests to complete")
+		writeTO  = fs.Duration("write-timeout", 0, "limit how long writing a response may take, or 0 for no limit; hosts may override it with write-timeout")
+		noKeep   = fs.Bool("disable-keepalive", false, "close client connections after each response")
+		mux      = fs.Bool("mux", false, "also serve plain HTTP on the -tls address, telling it apart by the first byte of each connection")
+		misdir   = fs.Bool("tls-misdirected", false, "respond 421 to TLS requests for hosts the connection's certificate doesn't cover")
+		hstsExcl = fs.String("hsts-exclude", "", "comma-separated hosts, host/paths, or /paths not to send HSTS headers for (optional)")
+		sysDest  = fs.String("syslog", "", "log to syslog instead of stderr: local, or network:address, e.g. udp:10.0.0.1:514 (optional)")
+		admin    = fs.String("admin", "", "serve the admin API on this loopback address or unix:path, e.g. 127.0.0.1:8081 (optional)")
+		adminPub = fs.Bool("admin-public", false, "allow -admin to be a non-loopback address")
+		noEmpty  = fs.Bool("reject-empty", false, "ignore reloaded configs with no hosts, rather than warning")
+		fdWarn   = fs.Float64("fd-warn", defaultFDWarn, "warn when this fraction of the open file limit is in use, or 0 to disable (Linux only)")
+		tlsPorts = fs.String("https-ports", "", "comma-separated backend ports to proxy to over HTTPS, e.g. 443,8443 (optional)")
+		idleReap = fs.Duration("idle-reap", 0, "close idle backend connections this often, e.g. when backends rotate behind a VIP, or 0 to disable")
+		warmup   = fs.Bool("warmup", false, "on startup and reload, connect to each backend with a HEAD request, and log those that are unreachable")
+		reloadTO = fs.Duration("reload-timeout", 10*time.Second, "give up on a config reload after this long")
+		config   = fs.String("config", "proxy.conf", "config file (JSON if it ends in .json)")
+		reqConf  = fs.Bool("require-config", false, "exit if -config doesn't exist, rather than using the built-in default config")
+		confDir  = fs.String("config-dir", "", "load and merge every *.conf and *.json file in this directory, instead of -config (optional)")
+		printVer = fs.Bool("version", false, "print the version, commit, and build date to stdout and exit")
 		example  = fs.Bool("example", false, "print example config file to stdout and exit")
+		exJSON   = fs.Bool("example-json", false, "print example JSON config file to stdout and exit")
 	)
 	fs.Usage = usageFor(fs, "http-proxy [flags]")
 	fs.Parse(os.Args[1:])
 
+	accessLog := log.Default()
+	if *sysDest != "" {
+		ops, access, err := dialSyslog(*sysDest)
+		if err != nil {
+			log.Printf("syslog unavailable, logging to stderr: %v", err)
+		} else {
+			log.SetOutput(ops)
+			log.SetFlags(0) // syslog adds timestamps
+			accessLog = log.New(access, "", 0)
+		}
+	}
+
+	if *certPEM == "" {
+		*certPEM = os.Getenv("PROXY_CERT_PEM")
+	}
+	if *keyPEM == "" {
+		*keyPEM = os.Getenv("PROXY_KEY_PEM")
+	}
+
+	if *printVer {
+		fmt.Fprintf(os.Stdout, "%s\n", versionString())
+		os.Exit(0)
+	}
+
 	if *example {
 		fmt.Fprintf(os.Stdout, "example.com, www.example.com: 8081\n")
 		fmt.Fprintf(os.Stdout, "subdomain.example.com: 10001\n")
@@ -45,62 +118,314 @@ func main() {
 		os.Exit(0)
 	}
 
-	var cfgmap atomic.Value
+	if *exJSON {
+		fmt.Fprintf(os.Stdout, "[\n")
+		fmt.Fprintf(os.Stdout, "  {\"hosts\": [\"example.com\", \"www.example.com\"], \"dest\": \"8081\"},\n")
+		fmt.Fprintf(os.Stdout, "  {\"hosts\": [\"subdomain.example.com\"], \"dest\": \"10001\", \"strip-header\": [\"Authorization\"]},\n")
+		fmt.Fprintf(os.Stdout, "  {\"hosts\": [\"www.website.online\"], \"dest\": \"/var/www/website.online\"}\n")
+		fmt.Fprintf(os.Stdout, "]\n")
+		os.Exit(0)
+	}
+
+	if *procs > 0 {
+		runtime.GOMAXPROCS(*procs)
+	}
+	log.Printf("using %d CPUs", runtime.GOMAXPROCS(0))
+
+	transport := proxy.NewTransport(*resolver, *dnsTTL)
+	transport.MaxResponseHeaderBytes = *maxResp
+	transports := proxy.NewTransportPool(transport)
+
+	var loadOptions []proxy.LoadOption
+	if *dbgHdrs {
+		loadOptions = append(loadOptions, proxy.WithDebugHeaders(strings.Split(*redact, ",")))
+	}
+	if *tlsPorts != "" {
+		loadOptions = append(loadOptions, proxy.WithHTTPSPorts(strings.FieldsFunc(*tlsPorts, isComma)))
+	}
+	if *dirCheck > 0 {
+		loadOptions = append(loadOptions, proxy.WithDirCheckInterval(*dirCheck))
+	}
+
+	load := func() (proxy.Configuration, error) {
+		if *confDir != "" {
+			return proxy.LoadDir(*confDir, transports, loadOptions...)
+		}
+		return proxy.Load(*config, transports, loadOptions...)
+	}
+
+	var handler *proxy.Handler
 	{
-		cfg, err := loadcfg(*config)
+		cfg, err := load()
+		if errors.Is(err, os.ErrNotExist) && *confDir == "" && !*reqConf {
+			log.Printf("WARNING: %s doesn't exist, using the built-in default config", *config)
+			var entries []proxy.Entry
+			if entries, err = proxy.ParseLines(bytes.NewReader(defaultConfig)); err == nil {
+				cfg, err = proxy.NewConfiguration(entries, transports, loadOptions...)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkEmpty(cfg, *noEmpty, *unmatch); err != nil {
+			log.Fatalf("%v (-reject-empty)", err)
+		}
+		unmatched, err := unmatchedHandler(*unmatch)
 		if err != nil {
 			log.Fatal(err)
 		}
-		cfgmap.Store(cfg)
+		if *sample < 0 || *sample > 1 {
+			log.Fatalf("invalid -log-sample %v: want 0.0 to 1.0", *sample)
+		}
+		options := []proxy.HandlerOption{proxy.WithUnmatched(unmatched), proxy.WithLogSample(*sample), proxy.WithAccessLog(accessLog)}
+		if *logTLS {
+			options = append(options, proxy.WithLogTLS())
+		}
+		if *fwdSNI {
+			options = append(options, proxy.WithForwardSNI())
+		}
+		switch *noHost {
+		case "":
+		case "400":
+			options = append(options, proxy.WithRejectEmptyHost())
+		default:
+			options = append(options, proxy.WithEmptyHost(*noHost))
+		}
+		if *logRule {
+			options = append(options, proxy.WithLogRule())
+		}
+		if *ruleHdr != "" {
+			options = append(options, proxy.WithRuleHeader(*ruleHdr))
+		}
+		handler = proxy.NewHandler(cfg, options...)
+	}
+
+	warm := func() {
+		if *warmup {
+			ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+			defer cancel()
+			transports.Warmup(ctx)
+		}
 	}
+	go warm()
 
-	var handler http.Handler
+	var manager *autocert.Manager
 	{
-		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			cfg := cfgmap.Load().(configuration)
-			proxy, ok := cfg[r.Host]
-			if !ok {
-				log.Printf("%s %s (%s) -> not configured", r.RemoteAddr, r.Host, r.URL.Path)
-				http.NotFound(w, r)
-				return
+		if *acmeDir != "" {
+			manager = &autocert.Manager{
+				Prompt: autocert.AcceptTOS,
+				Cache:  autocert.DirCache(*acmeDir),
+				Email:  *acmeMail,
+				HostPolicy: func(_ context.Context, host string) error {
+					if _, ok := handler.Configuration()[host]; !ok {
+						return errors.Errorf("host %s not configured", host)
+					}
+					return nil
+				},
 			}
-			log.Printf("%s %s (%s) -> %s", r.RemoteAddr, r.Host, r.URL.Path, proxy.dest)
-			proxy.ServeHTTP(w, r)
-		})
+		}
+	}
+
+	var certs *certificate // nil unless serving TLS from -cert and -key
+	if *tlsAddr != "" && manager == nil {
+		certs = &certificate{load: func() (tls.Certificate, error) {
+			return loadKeyPair(*cert, *certPEM, *chain, *key, *keyPEM)
+		}}
+		keypair, err := certs.reload()
+		if err != nil {
+			log.Fatalf("loading TLS certificate: %v", err)
+		}
+		log.Printf("serving TLS certificate chain of %d certificate(s)", len(keypair.Certificate))
+	}
+
+	lopts := listenOptions{
+		backlog:   *backlog,
+		reusePort: *reuse,
+		noDelay:   *noDelay,
+	}
+	if *perIP > 0 {
+		lopts.perIP = newIPLimiter(*perIP)
 	}
 
 	var g run.Group
 	{
 		ctx, cancel := context.WithCancel(context.Background())
+		// Loads are serialized, including any abandoned after a timeout that
+		// are still running, as they share the transport pool.
+		reload := serialized(load)
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
 		g.Add(func() error {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, syscall.SIGHUP)
-			for {
-				select {
-				case <-c:
-					log.Printf("received SIGHUP, reloading config...")
-					cfg, err := loadcfg(*config)
-					if err != nil {
-						log.Printf("bad config, ignoring (%v)", err)
-						continue
+			return reloadOnSignal(ctx, c, func() {
+				log.Printf("received SIGHUP, reloading config...")
+				if certs != nil {
+					if keypair, err := certs.reload(); err != nil {
+						log.Printf("bad TLS certificate, keeping previous one (%v)", err)
+					} else {
+						log.Printf("reloaded TLS certificate, expires %s", keypair.Leaf.NotAfter.UTC().Format(time.RFC3339))
 					}
-					cfgmap.Store(cfg)
-				case <-ctx.Done():
-					return ctx.Err()
 				}
-			}
+				cfg, err := loadTimeout(*reloadTO, reload)
+				if err == errTimeout {
+					log.Printf("reload timed out after %s, keeping previous config", *reloadTO)
+					return
+				}
+				if err != nil {
+					log.Printf("bad config, ignoring (%v)", err)
+					return
+				}
+				if err := checkEmpty(cfg, *noEmpty, *unmatch); err != nil {
+					log.Printf("%v, ignoring (-reject-empty)", err)
+					return
+				}
+				prev := handler.Configuration()
+				handler.SetConfiguration(cfg)
+				transports.Prune()
+				go warm()
+				if manager != nil {
+					go provision(manager, addedHosts(prev, cfg))
+				}
+			})
 		}, func(error) {
 			cancel()
 		})
 	}
+	{
+		if *dirCheck > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				ticker := time.NewTicker(*dirCheck)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						handler.Configuration().Check()
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}, func(error) {
+				cancel()
+			})
+		}
+	}
+	{
+		if *idleReap > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				ticker := time.NewTicker(*idleReap)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						transports.CloseIdleConnections()
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}, func(error) {
+				cancel()
+			})
+		}
+	}
+	{
+		if *admin != "" {
+			if !isLoopback(*admin) {
+				if !*adminPub {
+					log.Fatalf("-admin %s isn't a loopback address; set -admin-public to allow it", *admin)
+				}
+				log.Printf("WARNING: admin API on %s is reachable from other machines, and has no authentication", *admin)
+			}
+			server := &http.Server{Addr: *admin, Handler: adminHandler(handler, certs)}
+			ln, err := listen(*admin, listenOptions{})
+			if err != nil {
+				log.Fatal(err)
+			}
+			g.Add(func() error {
+				log.Printf("serving admin API on %s", *admin)
+				return server.Serve(ln)
+			}, func(error) {
+				ctx, cancel := context.WithTimeout(context.Background(), *shutTO)
+				defer cancel()
+				server.Shutdown(ctx)
+			})
+		}
+	}
+	{
+		if *fdWarn > 0 {
+			if _, _, err := openFiles(); err != nil {
+				log.Printf("not monitoring open files: %v", err)
+			} else {
+				ctx, cancel := context.WithCancel(context.Background())
+				g.Add(func() error {
+					ticker := time.NewTicker(10 * time.Second)
+					defer ticker.Stop()
+					var warned bool
+					for {
+						select {
+						case <-ticker.C:
+							n, limit, err := openFiles()
+							if err != nil {
+								continue
+							}
+							if high := float64(n) >= *fdWarn*float64(limit); high != warned {
+								if high {
+									log.Printf("WARNING: %d of %d file descriptors in use", n, limit)
+								} else {
+									log.Printf("%d of %d file descriptors in use, below -fd-warn again", n, limit)
+								}
+								warned = high
+							}
+						case <-ctx.Done():
+							return ctx.Err()
+						}
+					}
+				}, func(error) {
+					cancel()
+				})
+			}
+		}
+	}
+	var httpHandler http.Handler = handler
+	if manager != nil {
+		httpHandler = manager.HTTPHandler(handler) // enables the HTTP-01 challenge
+	}
+	var servers []*http.Server
 	{
 		if *tlsAddr != "" {
-			server := &http.Server{Addr: *tlsAddr, Handler: hsts(handler)}
+			server := &http.Server{Addr: *tlsAddr, Handler: hsts(handler, strings.FieldsFunc(*hstsExcl, isComma)), MaxHeaderBytes: *maxHdr, DisableGeneralOptionsHandler: true}
+			if manager != nil {
+				server.TLSConfig = manager.TLSConfig() // includes the TLS-ALPN-01 challenge
+			} else {
+				server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+			}
+			if *misdir {
+				server.Handler = misdirected(server.Handler, server.TLSConfig)
+			}
+			servers = append(servers, server)
+			ln, err := listen(*tlsAddr, lopts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if *mux {
+				var plainLn net.Listener
+				ln, plainLn = splitTLS(ln)
+				plain := &http.Server{Addr: *tlsAddr, Handler: httpHandler, MaxHeaderBytes: *maxHdr, DisableGeneralOptionsHandler: true}
+				servers = append(servers, plain)
+				g.Add(func() error {
+					log.Printf("serving HTTP on %s, alongside TLS", *tlsAddr)
+					return plain.Serve(plainLn)
+				}, func(error) {
+					ctx, cancel := context.WithTimeout(context.Background(), *shutTO)
+					defer cancel()
+					plain.Shutdown(ctx)
+				})
+			}
 			g.Add(func() error {
 				log.Printf("serving TLS on %s", *tlsAddr)
-				return server.ListenAndServeTLS(*cert, *key)
+				return server.ServeTLS(ln, "", "") // certificates are in TLSConfig
 			}, func(error) {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				ctx, cancel := context.WithTimeout(context.Background(), *shutTO)
 				defer cancel()
 				server.Shutdown(ctx)
 			})
@@ -110,12 +435,17 @@ func main() {
 	}
 	{
 		if *httpAddr != "" {
-			server := &http.Server{Addr: *httpAddr, Handler: handler}
+			server := &http.Server{Addr: *httpAddr, Handler: httpHandler, MaxHeaderBytes: *maxHdr, DisableGeneralOptionsHandler: true}
+			servers = append(servers, server)
+			ln, err := listen(*httpAddr, lopts)
+			if err != nil {
+				log.Fatal(err)
+			}
 			g.Add(func() error {
 				log.Printf("serving HTTP on %s", *httpAddr)
-				return server.ListenAndServe()
+				return server.Serve(ln)
 			}, func(error) {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				ctx, cancel := context.WithTimeout(context.Background(), *shutTO)
 				defer cancel()
 				server.Shutdown(ctx)
 			})
@@ -123,6 +453,7 @@ func main() {
 			log.Printf("not serving HTTP")
 		}
 	}
+	var closing atomic.Bool // with -disable-keepalive, or while draining
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
@@ -130,6 +461,21 @@ func main() {
 			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 			select {
 			case sig := <-c:
+				if *drain > 0 {
+					// Closing connections after each response moves clients
+					// elsewhere, while the servers still accept connections
+					// from load balancers that haven't yet stopped routing.
+					log.Printf("received signal %s, draining for %s", sig, *drain)
+					closing.Store(true)
+					for _, server := range servers {
+						server.SetKeepAlivesEnabled(false)
+					}
+					select {
+					case <-time.After(*drain):
+					case sig = <-c:
+					case <-ctx.Done():
+					}
+				}
 				return fmt.Errorf("received signal %s", sig)
 			case <-ctx.Done():
 				return ctx.Err()
@@ -138,53 +484,190 @@ func main() {
 			cancel()
 		})
 	}
+	for _, server := range servers {
+		server.WriteTimeout = *writeTO
+	}
+	if *noKeep {
+		closing.Store(true)
+		for _, server := range servers {
+			server.SetKeepAlivesEnabled(false)
+		}
+	}
+	if *noKeep || *drain > 0 {
+		for _, server := range servers {
+			server.Handler = connectionClose(server.Handler, &closing)
+		}
+	}
 	log.Printf("exit: %v", g.Run())
 }
 
-type configuration map[string]target
+// defaultConfig is used when the config file doesn't exist at startup.
+//
+//go:embed default.conf
+var defaultConfig []byte
+
+var errTimeout = errors.New("timeout")
 
-type target struct {
-	dest string
-	http.Handler
+// loadTimeout calls load, returning errTimeout if it doesn't complete within
+// the timeout, e.g. because of a hung filesystem. In that case load continues
+// in the background, and its result is discarded.
+func loadTimeout(timeout time.Duration, load func() (proxy.Configuration, error)) (proxy.Configuration, error) {
+	type result struct {
+		cfg proxy.Configuration
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		cfg, err := load()
+		c <- result{cfg, err}
+	}()
+	select {
+	case r := <-c:
+		return r.cfg, r.err
+	case <-time.After(timeout):
+		return nil, errTimeout
+	}
 }
 
-func loadcfg(filename string) (configuration, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return configuration{}, errors.Wrap(err, "Open failed")
+var errEmptyConfig = errors.New("config has no hosts")
+
+// checkEmpty returns errEmptyConfig if cfg has no hosts, e.g. because the
+// config file was truncated, and rejectEmpty is set. Otherwise, it warns about
+// an empty config, as every request would get the unmatched response.
+func checkEmpty(cfg proxy.Configuration, rejectEmpty bool, unmatched string) error {
+	if len(cfg) > 0 {
+		return nil
+	}
+	if rejectEmpty {
+		return errEmptyConfig
 	}
-	defer f.Close()
+	log.Printf("WARNING: config has no hosts, so every request is unmatched (-unmatched %s)", unmatched)
+	return nil
+}
 
-	var (
-		cfg = configuration{}
-		s   = bufio.NewScanner(f)
-	)
-	for s.Scan() {
-		toks := strings.SplitN(s.Text(), ":", 2)
-		if len(toks) != 2 {
-			return cfg, errors.Errorf("bad line: %s", s.Text())
-		}
-		var (
-			hosts, dest = toks[0], strings.TrimSpace(toks[1])
-			handler     http.Handler
-		)
-		if _, err := strconv.Atoi(dest); err == nil {
-			hostport := net.JoinHostPort("127.0.0.1", dest)
-			u := &url.URL{Scheme: "http", Host: hostport}
-			handler = httputil.NewSingleHostReverseProxy(u)
-		} else if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
-			handler = http.FileServer(http.Dir(dest))
-		} else {
-			return cfg, errors.Errorf("invalid proxy target: %s", s.Text())
+// reloadOnSignal calls reload on each signal from c, until ctx is done.
+// Signals that arrive during a reload coalesce into a single subsequent one.
+func reloadOnSignal(ctx context.Context, c <-chan os.Signal, reload func()) error {
+	for {
+		select {
+		case <-c:
+			for len(c) > 0 {
+				<-c
+			}
+			reload()
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		for _, host := range strings.Split(hosts, ",") {
-			src := strings.TrimSpace(host)
-			log.Printf("loadcfg %s -> %s", src, dest)
-			cfg[src] = target{dest: dest, Handler: handler}
+	}
+}
+
+// serialized returns a function calling load, one call at a time.
+func serialized(load func() (proxy.Configuration, error)) func() (proxy.Configuration, error) {
+	var mtx sync.Mutex
+	return func() (proxy.Configuration, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return load()
+	}
+}
+
+// addedHosts returns the hosts in next that aren't in prev.
+func addedHosts(prev, next proxy.Configuration) []string {
+	var hosts []string
+	for host := range next {
+		if _, ok := prev[host]; !ok && host != "" {
+			hosts = append(hosts, host)
 		}
 	}
+	sort.Strings(hosts)
+	return hosts
+}
 
-	return cfg, nil
+// provision obtains ACME certificates for the hosts, one at a time, so they're
+// ready before the first request.
+func provision(manager *autocert.Manager, hosts []string) {
+	for _, host := range hosts {
+		log.Printf("provisioning certificate for %s", host)
+		if _, err := manager.GetCertificate(ecdsaHello(host)); err != nil {
+			log.Printf("provisioning certificate for %s failed: %v", host, err)
+			continue
+		}
+		log.Printf("provisioned certificate for %s", host)
+	}
+}
+
+// ecdsaHello returns a ClientHelloInfo for serverName from a modern client,
+// which supports ECDSA. Given a hello without any of these, autocert picks its
+// legacy RSA certificate, rather than the ECDSA one most clients get.
+func ecdsaHello(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       serverName,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+}
+
+// unmatchedHandler returns the handler for requests to unconfigured hosts.
+// The mode is 404, close, or an HTTP status code.
+func unmatchedHandler(mode string) (http.Handler, error) {
+	switch mode {
+	case "404":
+		return http.HandlerFunc(http.NotFound), nil
+	case "close":
+		return http.HandlerFunc(closeConnection), nil
+	}
+	code, err := strconv.Atoi(mode)
+	if err != nil || code < 100 || code > 999 {
+		return nil, errors.Errorf("invalid -unmatched %q: want 404, close, or a status code", mode)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}), nil
+}
+
+// closeConnection closes the client connection without writing a response.
+func closeConnection(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler) // e.g. HTTP/2, where this resets the stream
+	}
+	conn.Close()
+}
+
+// warmupTimeout limits how long -warmup waits for backends to respond.
+const warmupTimeout = 10 * time.Second
+
+// loadKeyPair builds a TLS certificate from PEM-encoded material. Inline PEM
+// takes precedence; if it's empty, the corresponding file is read instead.
+func loadKeyPair(certFile, certPEM, chainFile, keyFile, keyPEM string) (tls.Certificate, error) {
+	certData, err := pemOrFile(certPEM, certFile)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "reading certificate")
+	}
+	if chainFile != "" {
+		chain, err := os.ReadFile(chainFile)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "reading chain")
+		}
+		certData = append(append(certData, '\n'), chain...)
+	}
+	keyData, err := pemOrFile(keyPEM, keyFile)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "reading key")
+	}
+	keypair, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "X509KeyPair failed")
+	}
+	return keypair, nil
+}
+
+func pemOrFile(inline, filename string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	return os.ReadFile(filename)
 }
 
 func usageFor(fs *flag.FlagSet, short string) func() {
@@ -204,14 +687,100 @@ func usageFor(fs *flag.FlagSet, short string) func() {
 		tw.Flush()
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "VERSION\n")
-		fmt.Fprintf(os.Stderr, "  %s\n", version)
+		fmt.Fprintf(os.Stderr, "  %s\n", versionString())
 		fmt.Fprintf(os.Stderr, "\n")
 	}
 }
 
-func hsts(next http.Handler) http.Handler {
+// connectionClose sets Connection: close on responses while closing is set.
+// Without it, net/http still answers HTTP/1.0 requests for keep-alive with
+// Connection: keep-alive when keep-alives are disabled, even though it closes
+// the connection.
+func connectionClose(next http.Handler, closing *atomic.Bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		if closing.Load() {
+			w.Header().Set("Connection", "close")
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// hsts adds the Strict-Transport-Security header to responses, except for
+// requests matching an exclusion: a host, a host and path prefix, e.g.
+// example.com/callback, or a path prefix on any host, e.g. /callback.
+func hsts(next http.Handler, exclude []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hstsExcluded(r, exclude) {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// misdirected responds 421 Misdirected Request to TLS requests for hosts the
+// connection's certificate isn't valid for, e.g. when an HTTP/2 client reuses
+// a connection for another host, so the client retries on a new connection.
+// Connections without SNI aren't checked.
+func misdirected(next http.Handler, config *tls.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			leaf, err := certificateFor(config, r.TLS.ServerName)
+			if err == nil {
+				err = leaf.VerifyHostname(host)
+			}
+			if err != nil {
+				http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certificateFor returns the leaf certificate config serves for serverName.
+// With ACME, that's the ECDSA certificate most clients get, which covers the
+// same hosts as the RSA one.
+func certificateFor(config *tls.Config, serverName string) (*x509.Certificate, error) {
+	var cert *tls.Certificate
+	switch {
+	case config.GetCertificate != nil:
+		var err error
+		if cert, err = config.GetCertificate(ecdsaHello(serverName)); err != nil {
+			return nil, err
+		}
+		if cert == nil {
+			return nil, errors.Errorf("no certificate for %s", serverName)
+		}
+	case len(config.Certificates) > 0:
+		cert = &config.Certificates[0]
+	default:
+		return nil, errors.New("no certificates configured")
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+func isComma(r rune) bool { return r == ',' }
+
+func hstsExcluded(r *http.Request, exclude []string) bool {
+	reqHost := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		reqHost = h
+	}
+	for _, x := range exclude {
+		host, path := x, ""
+		if i := strings.Index(x, "/"); i >= 0 {
+			host, path = x[:i], x[i:]
+		}
+		if (host == "" || host == reqHost) && strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
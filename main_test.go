@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/http-proxy/proxy"
+)
+
+// selfSigned returns a self-signed certificate for the hosts.
+func selfSigned(t *testing.T, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateFor(t *testing.T) {
+	cert := selfSigned(t, "a.com", "b.com")
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }
+
+	for name, config := range map[string]*tls.Config{
+		"Certificates":   {Certificates: []tls.Certificate{cert}},
+		"GetCertificate": {GetCertificate: getCertificate},
+	} {
+		t.Run(name, func(t *testing.T) {
+			leaf, err := certificateFor(config, "a.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := leaf.VerifyHostname("b.com"); err != nil {
+				t.Error(err)
+			}
+			if err := leaf.VerifyHostname("c.com"); err == nil {
+				t.Error("c.com: want error, have none")
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		if _, err := certificateFor(&tls.Config{}, "a.com"); err == nil {
+			t.Error("want error, have none")
+		}
+	})
+}
+
+func TestMisdirected(t *testing.T) {
+	cert := selfSigned(t, "a.com")
+	certs := &certificate{load: func() (tls.Certificate, error) { return cert, nil }}
+	if _, err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tls.Config{GetCertificate: certs.GetCertificate}
+	server := httptest.NewUnstartedServer(misdirected(http.NotFoundHandler(), config))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certs.current.Load().Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "a.com"},
+	}}
+	for host, want := range map[string]int{
+		"a.com": http.StatusNotFound,
+		"b.com": http.StatusMisdirectedRequest,
+	} {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: want %d, have %d", host, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestReloadSerialized(t *testing.T) {
+	var (
+		loads   atomic.Int32
+		release = make(chan struct{})
+	)
+	reload := serialized(func() (proxy.Configuration, error) {
+		if loads.Add(1) == 1 {
+			<-release
+		}
+		return proxy.Configuration{}, nil
+	})
+
+	// The first reload times out, but keeps running, and so holds up the
+	// second, which would otherwise return at once, until it's done.
+	if _, err := loadTimeout(10*time.Millisecond, reload); err != errTimeout {
+		t.Fatalf("first reload: want errTimeout, have %v", err)
+	}
+	if _, err := loadTimeout(10*time.Millisecond, reload); err != errTimeout {
+		t.Fatalf("second reload: want errTimeout, have %v", err)
+	}
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("want 1 load started, have %d", n)
+	}
+	close(release)
+	if _, err := loadTimeout(time.Second, reload); err != nil {
+		t.Errorf("third reload: %v", err)
+	}
+	if n := loads.Load(); n != 3 {
+		t.Errorf("want 3 loads, have %d", n)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	var (
+		c       = make(chan os.Signal, 10)
+		started = make(chan struct{})
+		release = make(chan struct{})
+		loads   atomic.Int32
+		done    = make(chan error)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- reloadOnSignal(ctx, c, func() {
+			loads.Add(1)
+			started <- struct{}{}
+			<-release
+		})
+	}()
+
+	// A burst of signals during a slow reload gets a single follow-up.
+	c <- syscall.SIGHUP
+	<-started
+	for i := 0; i < cap(c); i++ {
+		c <- syscall.SIGHUP
+	}
+	release <- struct{}{}
+	<-started
+	if n := len(c); n != 0 {
+		t.Fatalf("want no signals pending during the follow-up reload, have %d", n)
+	}
+	release <- struct{}{}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("want context.Canceled, have %v", err)
+	}
+	if n := loads.Load(); n != 2 {
+		t.Errorf("want 2 reloads, have %d", n)
+	}
+}
+
+func TestLoadKeyPairChain(t *testing.T) {
+	for name, newKey := range map[string]func() (crypto.Signer, error){
+		"ECDSA": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+		"Ed25519": func() (crypto.Signer, error) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			return key, err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			caKey, err := newKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			leafKey, err := newKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ca := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "intermediate"},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+			}
+			caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, caKey.Public(), caKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				DNSNames:     []string{"a.com"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, leafKey.Public(), caKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				certFile  = writePEM(t, dir, "server.crt", "CERTIFICATE", leafDER)
+				chainFile = writePEM(t, dir, "chain.crt", "CERTIFICATE", caDER)
+				keyFile   = writePEM(t, dir, "server.key", "PRIVATE KEY", keyDER)
+			)
+
+			keypair, err := loadKeyPair(certFile, "", chainFile, keyFile, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(keypair.Certificate); n != 2 {
+				t.Fatalf("want 2 certificates, have %d", n)
+			}
+
+			server := httptest.NewUnstartedServer(http.NotFoundHandler())
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{keypair}}
+			server.StartTLS()
+			defer server.Close()
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if n := len(conn.ConnectionState().PeerCertificates); n != 2 {
+				t.Errorf("want a chain of 2 served, have %d", n)
+			}
+		})
+	}
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCheckEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "proxy.conf")
+	if err := os.WriteFile(filename, []byte("\xef\xbb\xbf\n  \r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := proxy.Load(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty) != 0 {
+		t.Fatalf("want no hosts, have %d", len(empty))
+	}
+	nonEmpty := proxy.Configuration{"a.com": proxy.Target{Dest: "8080"}}
+
+	for _, test := range []struct {
+		cfg         proxy.Configuration
+		rejectEmpty bool
+		wantErr     error
+		wantWarning bool
+	}{
+		{empty, false, nil, true},
+		{empty, true, errEmptyConfig, false},
+		{nonEmpty, false, nil, false},
+		{nonEmpty, true, nil, false},
+	} {
+		buf.Reset()
+		err := checkEmpty(test.cfg, test.rejectEmpty, "404")
+		if err != test.wantErr {
+			t.Errorf("%d hosts, rejectEmpty %v: want error %v, have %v", len(test.cfg), test.rejectEmpty, test.wantErr, err)
+		}
+		if warned := bytes.Contains(buf.Bytes(), []byte("WARNING")); warned != test.wantWarning {
+			t.Errorf("%d hosts, rejectEmpty %v: want warning %v, have %v", len(test.cfg), test.rejectEmpty, test.wantWarning, warned)
+		}
+	}
+}
+
+func TestAdminCrossOrigin(t *testing.T) {
+	cfg, err := proxy.NewConfiguration([]proxy.Entry{{Hosts: []string{"a.com"}, Dest: "text:200:ok"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := adminHandler(proxy.NewHandler(cfg), nil)
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"curl", http.Header{}, http.StatusOK},
+		{"same origin", http.Header{"Sec-Fetch-Site": {"same-origin"}}, http.StatusOK},
+		{"cross site", http.Header{"Sec-Fetch-Site": {"cross-site"}}, http.StatusForbidden},
+		{"other origin", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", "http://127.0.0.1:8081/hosts/a.com/disable", nil)
+		req.Header = test.header
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: want %d, have %d", test.name, test.want, rec.Code)
+		}
+	}
+}
+
+// readFromConn records whether it was written to with ReadFrom.
+type readFromConn struct {
+	net.Conn
+	readFrom bool
+}
+
+func (c *readFromConn) ReadFrom(r io.Reader) (int64, error) {
+	c.readFrom = true
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+func TestConnReadFrom(t *testing.T) {
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		"limitConn":  func(c net.Conn) net.Conn { return &limitConn{Conn: c, release: func() {}} },
+		"peekedConn": func(c net.Conn) net.Conn { return &peekedConn{Conn: c, r: bufio.NewReader(c)} },
+	} {
+		server, client := net.Pipe()
+		go io.Copy(io.Discard, client)
+		inner := &readFromConn{Conn: server}
+		conn := wrap(inner)
+		if _, err := io.Copy(conn, io.LimitReader(strings.NewReader("body"), 4)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		conn.Close()
+		if !inner.readFrom {
+			t.Errorf("%s: want the connection's ReadFrom used, have Write", name)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := listen("unix:"+path, listenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:"+path, listenOptions{}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("socket in use: want address in use error, have %v", err)
+	}
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Errorf("socket in use: first listener lost its socket: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// A socket left behind by a process that died is removed.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if ln, err = listen("unix:"+path, listenOptions{}); err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	ln.Close()
+}
+
+func TestConnectionClose(t *testing.T) {
+	var closing atomic.Bool
+	h := connectionClose(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), &closing)
+	for _, want := range []string{"", "close"} {
+		closing.Store(want != "")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if have := rec.Header().Get("Connection"); have != want {
+			t.Errorf("closing %v: want Connection %q, have %q", closing.Load(), want, have)
+		}
+	}
+}
+
+func TestAdminCanary(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	cfg, err := proxy.NewConfiguration([]proxy.Entry{
+		{Hosts: []string{"a.com"}, Dest: backend.URL, Canary: &proxy.Canary{Dest: backend.URL, Percent: 5}},
+		{Hosts: []string{"b.com"}, Dest: backend.URL},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := proxy.NewHandler(cfg)
+	admin := adminHandler(handler, nil)
+	for path, want := range map[string]int{
+		"/hosts/a.com/canary?percent=25": http.StatusOK,
+		"/hosts/a.com/canary?percent=":   http.StatusBadRequest,
+		"/hosts/a.com/canary?percent=-1": http.StatusBadRequest,
+		"/hosts/b.com/canary?percent=25": http.StatusNotFound,
+		"/hosts/c.com/canary?percent=25": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: want %d, have %d", path, want, rec.Code)
+		}
+	}
+	if percent := handler.Canaries()["a.com"]; percent != 25 {
+		t.Errorf("want a.com canary at 25%%, have %v%%", percent)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// sniffTimeout limits how long a connection may take to send its first byte,
+// before it can be passed to the TLS or HTTP server.
+const sniffTimeout = 10 * time.Second
+
+// splitTLS splits the connections accepted from ln by their first byte: TLS
+// handshakes start with 0x16, and anything else is taken to be plain HTTP.
+// Closing either returned listener closes ln.
+func splitTLS(ln net.Listener) (tlsLn, plainLn net.Listener) {
+	m := &mux{
+		Listener: ln,
+		tls:      make(chan net.Conn),
+		plain:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go m.run()
+	return &muxListener{m, m.tls}, &muxListener{m, m.plain}
+}
+
+type mux struct {
+	net.Listener
+	tls, plain chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+func (m *mux) run() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			m.close(err)
+			return
+		}
+		go m.sniff(conn)
+	}
+}
+
+func (m *mux) sniff(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	b, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c := m.plain
+	if b[0] == 0x16 {
+		c = m.tls
+	}
+	select {
+	case c <- &peekedConn{Conn: conn, r: r}:
+	case <-m.done:
+		conn.Close()
+	}
+}
+
+func (m *mux) close(err error) {
+	m.once.Do(func() {
+		m.err = err
+		close(m.done)
+		m.Listener.Close()
+	})
+}
+
+// muxListener accepts one kind of connection from a mux.
+type muxListener struct {
+	*mux
+	c chan net.Conn
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.c:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.close(net.ErrClosed)
+	return nil
+}
+
+// peekedConn reads through the buffer holding the bytes that were peeked.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// ReadFrom keeps the connection's sendfile, as in limitConn.
+func (c *peekedConn) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(c.Conn, r)
+}
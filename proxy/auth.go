@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd maps users to password hashes, as read from an htpasswd file.
+type htpasswd map[string]string
+
+// readHtpasswd reads an htpasswd file. Only bcrypt ($2y$), MD5 ($apr1$), and
+// SHA-1 ({SHA}) hashes are supported, as created by htpasswd -B, -m, and -s.
+func readHtpasswd(filename string) (htpasswd, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		users = htpasswd{}
+		s     = bufio.NewScanner(f)
+	)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, errors.Errorf("%s:%d: want user:hash", filename, n)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$2"), strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "{SHA}"):
+		default:
+			return nil, errors.Errorf("%s:%d: unsupported hash for %s, want bcrypt, apr1, or SHA", filename, n, user)
+		}
+		users[user] = hash
+	}
+	return users, s.Err()
+}
+
+// verify reports whether password is correct for user.
+func (h htpasswd) verify(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	default:
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	}
+}
+
+// apr1 returns the Apache variant of the MD5-crypt hash of password.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var b strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[i[0]])<<16|uint32(final[i[1]])<<8|uint32(final[i[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + b.String()
+}
+
+// basicAuth requires requests to have HTTP basic auth credentials for one of
+// the users, and responds 401 Unauthorized otherwise.
+type basicAuth struct {
+	realm string
+	users htpasswd
+	next  http.Handler
+}
+
+func (a *basicAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok || !a.users.verify(user, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+a.realm+`", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+func (a *basicAuth) check() {
+	check(a.next)
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+)
+
+// canarySplit sends a percentage of requests to the canary backend, and the
+// rest to the stable backend.
+type canarySplit struct {
+	stable     http.Handler
+	canary     http.Handler
+	stableDest string
+	canaryDest string
+	percent    float64
+	sticky     bool
+}
+
+func (c *canarySplit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var n float64 // in [0, 100)
+	if c.sticky {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		h := fnv.New32a()
+		h.Write([]byte(ip))
+		n = float64(h.Sum32()%10000) / 100
+	} else {
+		n = rand.Float64() * 100
+	}
+	if n < canaryPercent(r, c.percent) {
+		setBackend(r, c.canaryDest+" (canary)")
+		c.canary.ServeHTTP(w, r)
+		return
+	}
+	setBackend(r, c.stableDest)
+	c.stable.ServeHTTP(w, r)
+}
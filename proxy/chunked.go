@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// How request bodies of unknown length, i.e. chunked, are proxied.
+const (
+	chunkedPass   = "pass"   // as they are, chunked
+	chunkedBuffer = "buffer" // read in full, and sent with a Content-Length
+	chunkedReject = "reject" // not at all, the client gets 411 Length Required
+)
+
+// maxChunkedBuffer is the largest chunked request body that's buffered.
+// Larger bodies are rejected with 413 Request Entity Too Large.
+const maxChunkedBuffer = 10 << 20
+
+// parseChunked parses the chunked option, which defaults to pass.
+func parseChunked(s string) (string, error) {
+	switch s {
+	case "":
+		return chunkedPass, nil
+	case chunkedPass, chunkedBuffer, chunkedReject:
+		return s, nil
+	}
+	return "", errors.Errorf("%q: want pass, buffer, or reject", s)
+}
+
+// chunkedBodies handles requests to next whose bodies are of unknown length
+// according to mode.
+func chunkedBodies(mode string, next http.Handler) http.Handler {
+	if mode == chunkedPass {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength >= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if mode == chunkedReject {
+			http.Error(w, "Content-Length required", http.StatusLengthRequired)
+			return
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, maxChunkedBuffer+1))
+		switch {
+		case err != nil:
+			log.Printf("%s %s (%s) -> reading chunked body: %v", r.RemoteAddr, r.Host, r.URL.Path, err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		case len(buf) > maxChunkedBuffer:
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.Body = http.NoBody
+		if len(buf) > 0 {
+			r2.Body = io.NopCloser(bytes.NewReader(buf))
+		}
+		r2.ContentLength = int64(len(buf))
+		r2.TransferEncoding = nil
+		next.ServeHTTP(w, r2)
+	})
+}
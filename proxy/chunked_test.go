@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChunked(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %q %s", r.ContentLength, r.TransferEncoding, body)
+	}))
+	defer backend.Close()
+	const body = "hello"
+
+	for _, test := range []struct {
+		mode    string
+		size    int // of the body sent
+		code    int
+		backend string // what the backend saw
+	}{
+		{"", len(body), http.StatusOK, `-1 ["chunked"] hello`},
+		{"pass", len(body), http.StatusOK, `-1 ["chunked"] hello`},
+		{"buffer", len(body), http.StatusOK, `5 [] hello`},
+		{"buffer", 0, http.StatusOK, `0 [] `},
+		{"buffer", maxChunkedBuffer + 1, http.StatusRequestEntityTooLarge, ""},
+		{"reject", len(body), http.StatusLengthRequired, ""},
+	} {
+		name := fmt.Sprintf("chunked=%s, %d bytes", test.mode, test.size)
+		proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, Chunked: test.mode}}))
+
+		// A reader of unknown length, so the request is chunked.
+		r := io.MultiReader(strings.NewReader(strings.Repeat(body, test.size/len(body))), strings.NewReader(body[:test.size%len(body)]))
+		req, _ := http.NewRequest("POST", proxy.URL, r)
+		req.Host = "a.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		have, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		proxy.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: want %d, have %d", name, test.code, resp.StatusCode)
+			continue
+		}
+		if test.backend != "" && string(have) != test.backend {
+			t.Errorf("%s: want backend to see %s, have %s", name, test.backend, have)
+		}
+	}
+
+	// Requests with a Content-Length are proxied as they are.
+	for _, mode := range []string{"pass", "buffer", "reject"} {
+		proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, Chunked: mode}}))
+		req, _ := http.NewRequest("POST", proxy.URL, strings.NewReader(body))
+		req.Host = "a.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("chunked=%s, Content-Length: %v", mode, err)
+		}
+		have, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		proxy.Close()
+		if string(have) != `5 [] hello` {
+			t.Errorf("chunked=%s, Content-Length: want backend to see 5 [] hello, have %s", mode, have)
+		}
+	}
+}
+
+func TestParseChunked(t *testing.T) {
+	for _, s := range []string{"pass", "buffer", "reject", ""} {
+		if _, err := parseChunked(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	if _, err := parseChunked("yes"); err == nil {
+		t.Error(`"yes": want error, have none`)
+	}
+}
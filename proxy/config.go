@@ -0,0 +1,656 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Configuration maps hosts to their targets.
+type Configuration map[string]Target
+
+// Target serves requests for a host. Dest describes where the requests are
+// served from, for logging.
+type Target struct {
+	Dest string
+	http.Handler
+
+	// Listeners, if not empty, restricts the target to requests received on
+	// those listeners: "http" for plain HTTP, "tls" for HTTPS, or both.
+	// Requests received on others are treated as if the host weren't
+	// configured.
+	Listeners []string
+
+	canary bool // whether the percentage can be set with Handler.SetCanary
+}
+
+// serves reports whether the target serves r, given the listener it was
+// received on.
+func (t Target) serves(r *http.Request) bool {
+	if len(t.Listeners) == 0 {
+		return true
+	}
+	listener := "http"
+	if r.TLS != nil {
+		listener = "tls"
+	}
+	for _, l := range t.Listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks the availability of resources used by the targets, such as
+// the directories of file servers. It should be called periodically.
+func (c Configuration) Check() {
+	for _, t := range c {
+		check(t.Handler)
+	}
+}
+
+// check checks h, if it uses resources that can become unavailable. Handlers
+// wrapping others should implement check by checking them.
+func check(h http.Handler) {
+	if c, ok := h.(interface{ check() }); ok {
+		c.check()
+	}
+}
+
+// Load loads the config file at filename. Files ending in .json are parsed as a
+// JSON array of entries; all others use the line format. Reverse proxies get
+// their transports from the pool, which may be nil.
+func Load(filename string, transports *TransportPool, options ...LoadOption) (Configuration, error) {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	return NewConfiguration(entries, transports, options...)
+}
+
+// LoadDir loads every *.conf and *.json file in dir, in sorted order, and
+// merges them into a single configuration. It's an error for two files to
+// configure the same host.
+func LoadDir(dir string, transports *TransportPool, options ...LoadOption) (Configuration, error) {
+	var filenames []string
+	for _, pattern := range []string{"*.conf", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return Configuration{}, errors.Wrap(err, "Glob failed")
+		}
+		filenames = append(filenames, matches...)
+	}
+	sort.Strings(filenames)
+
+	var (
+		entries []Entry
+		defined = map[string]string{} // host to filename
+	)
+	for _, filename := range filenames {
+		e, err := readEntries(filename)
+		if err != nil {
+			return Configuration{}, errors.Wrap(err, filename)
+		}
+		for _, entry := range e {
+			for _, host := range entry.Hosts {
+				if prev, ok := defined[host]; ok && prev != filename {
+					return Configuration{}, errors.Errorf("%s is configured in both %s and %s", host, prev, filename)
+				}
+				defined[host] = filename
+			}
+		}
+		entries = append(entries, e...)
+	}
+
+	return NewConfiguration(entries, transports, options...)
+}
+
+// readEntries reads the entries in the config file at filename.
+func readEntries(filename string) ([]Entry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Open failed")
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return ParseJSON(f)
+	default:
+		return ParseLines(f)
+	}
+}
+
+// NewConfiguration builds a configuration from entries. Reverse proxies get
+// their transports from the pool, which may be nil.
+func NewConfiguration(entries []Entry, transports *TransportPool, options ...LoadOption) (Configuration, error) {
+	var o loadOptions
+	for _, option := range options {
+		option(&o)
+	}
+	if transports == nil {
+		transports = NewTransportPool(http.DefaultTransport.(*http.Transport))
+	}
+	transports.reset()
+
+	if err := checkRedirects(entries); err != nil {
+		return Configuration{}, err
+	}
+
+	var (
+		cfg    = Configuration{}
+		routes = map[string][]prefixRoute{}
+	)
+	for _, e := range entries {
+		handler, err := e.handler(transports, o)
+		if err == nil {
+			err = e.checkListeners()
+		}
+		if err != nil {
+			return cfg, errors.Wrapf(err, "invalid proxy target for %s", strings.Join(e.Hosts, ", "))
+		}
+		for _, src := range e.Hosts {
+			log.Printf("loadcfg %s -> %s", src, e.describe())
+			if host, prefix := splitHostPrefix(src); prefix != "" {
+				routes[host] = append(routes[host], prefixRoute{prefix: prefix, dest: e.describe(), Handler: handler})
+				continue
+			}
+			cfg[src] = Target{Dest: e.describe(), Handler: handler, Listeners: e.Listeners, canary: e.Canary != nil}
+		}
+	}
+	for host, r := range routes {
+		router := newPrefixRouter(r, cfg[host])
+		cfg[host] = Target{Dest: router.describe(), Handler: router, Listeners: cfg[host].Listeners}
+	}
+
+	return cfg, nil
+}
+
+// checkListeners returns an error if the entry's listeners aren't valid.
+// Listeners apply to whole hosts, so they can't be set for path prefixes.
+func (e Entry) checkListeners() error {
+	for _, l := range e.Listeners {
+		if l != "http" && l != "tls" {
+			return errors.Errorf("listeners: %q isn't a listener, want http or tls", l)
+		}
+	}
+	for _, src := range e.Hosts {
+		if _, prefix := splitHostPrefix(src); prefix != "" && len(e.Listeners) > 0 {
+			return errors.Errorf("listeners: can't be set for %s, set it for the host instead", src)
+		}
+	}
+	return nil
+}
+
+// LoadOption configures how a configuration is built, for every entry.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	debugHeaders bool
+	redact       map[string]bool
+	httpsPorts   map[string]bool
+	retryAfter   time.Duration
+}
+
+// WithDirCheckInterval sets how often Configuration.Check is called. File
+// servers whose directory is unavailable send it as the Retry-After of their
+// 503 responses, as that's the soonest they can be available again.
+func WithDirCheckInterval(interval time.Duration) LoadOption {
+	return func(o *loadOptions) { o.retryAfter = interval }
+}
+
+// WithHTTPSPorts proxies to backends given as a port or host:port over
+// HTTPS, rather than HTTP, if the port is one of ports. Backends given as
+// http:// URLs are unaffected.
+func WithHTTPSPorts(ports []string) LoadOption {
+	return func(o *loadOptions) {
+		o.httpsPorts = map[string]bool{}
+		for _, port := range ports {
+			o.httpsPorts[port] = true
+		}
+	}
+}
+
+// WithDebugHeaders logs the headers of every request proxied to a backend,
+// and of the response. The values of the redacted headers aren't logged.
+func WithDebugHeaders(redact []string) LoadOption {
+	return func(o *loadOptions) {
+		o.debugHeaders = true
+		o.redact = map[string]bool{}
+		for _, name := range redact {
+			o.redact[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// checkRedirects returns an error if following the redirect options from any
+// host would lead back to that host.
+func checkRedirects(entries []Entry) error {
+	redirects := map[string]string{}
+	for _, e := range entries {
+		for _, host := range e.Hosts {
+			if e.Redirect != "" {
+				redirects[host] = e.Redirect
+			}
+		}
+	}
+	for host := range redirects {
+		var (
+			chain = []string{host}
+			seen  = map[string]bool{host: true}
+		)
+		for next, ok := redirects[host]; ok; next, ok = redirects[next] {
+			chain = append(chain, next)
+			if seen[next] {
+				return errors.Errorf("redirect loop: %s", strings.Join(chain, " -> "))
+			}
+			seen[next] = true
+		}
+	}
+	return nil
+}
+
+// Entry is a single config entry: one or more hosts, the destination they're
+// proxied to, and any per-host options. In the line format, options are given
+// as key=value after the destination; in the JSON format, they're fields with
+// the same names.
+type Entry struct {
+	Hosts                    []string      `json:"hosts"`
+	Dest                     string        `json:"dest"`
+	StripHeader              []string      `json:"strip-header,omitempty"`
+	StripResponseHeader      []string      `json:"strip-response-header,omitempty"`
+	HeadersFile              string        `json:"headers-file,omitempty"`
+	AllowStatus              []string      `json:"allow-status,omitempty"`
+	SPA                      bool          `json:"spa,omitempty"`
+	ForwardClientPort        bool          `json:"forward-client-port,omitempty"`
+	ForwardHost              bool          `json:"forward-host,omitempty"`
+	ContentType              string        `json:"content-type,omitempty"`
+	Redirect                 string        `json:"redirect,omitempty"`
+	RedirectStatus           int           `json:"redirect-status,omitempty"`
+	PreservePath             bool          `json:"preserve-path,omitempty"`
+	Rewrite                  *Rewrite      `json:"rewrite,omitempty"`
+	Replace                  []Replacement `json:"replace,omitempty"`
+	CookieDomain             []Replacement `json:"cookie-domain,omitempty"`
+	CookiePath               []Replacement `json:"cookie-path,omitempty"`
+	AddQuery                 []QueryParam  `json:"add-query,omitempty"`
+	SetQuery                 []QueryParam  `json:"set-query,omitempty"`
+	StripQuery               []string      `json:"strip-query,omitempty"`
+	Cache                    []CacheRule   `json:"cache,omitempty"`
+	Timeout                  string        `json:"timeout,omitempty"`
+	TimeoutPage              string        `json:"timeout-page,omitempty"`
+	HeaderTimeout            string        `json:"header-timeout,omitempty"`
+	WriteTimeout             string        `json:"write-timeout,omitempty"`
+	WebSocketIdleTimeout     string        `json:"websocket-idle-timeout,omitempty"`
+	DebugBody                int           `json:"debug-body,omitempty"`
+	Buffer                   int           `json:"buffer,omitempty"`
+	Gzip                     bool          `json:"gzip,omitempty"`
+	GzipLevel                int           `json:"gzip-level,omitempty"`
+	NoGzip                   []string      `json:"nogzip,omitempty"`
+	Chunked                  string        `json:"chunked,omitempty"`
+	SNI                      string        `json:"sni,omitempty"`
+	Via                      string        `json:"via,omitempty"`
+	DisableUpstreamKeepAlive bool          `json:"disable-upstream-keepalive,omitempty"`
+	Fallback                 string        `json:"fallback,omitempty"`
+	AuthFile                 string        `json:"authfile,omitempty"`
+	UpstreamAuth             string        `json:"upstream-auth,omitempty"`
+	Canary                   *Canary       `json:"canary,omitempty"`
+	Listeners                []string      `json:"listeners,omitempty"`
+}
+
+// CacheRule sets the Cache-Control header of files served by a file server
+// whose path matches Pattern: a path prefix if it starts with /, a file
+// extension if it starts with ., or every file if it's *.
+type CacheRule struct {
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+}
+
+// Canary sends a percentage of requests to a different backend. If Sticky is
+// true, the choice is made by hashing the client IP, so each client
+// consistently goes to the same backend; otherwise it's random.
+type Canary struct {
+	Dest    string  `json:"dest"`
+	Percent float64 `json:"percent"`
+	Sticky  bool    `json:"sticky,omitempty"`
+}
+
+// QueryParam is a query parameter added to, or set on, requests before
+// they're proxied.
+type QueryParam struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Replacement replaces every occurrence of Old with New in HTML files served
+// by a file server.
+type Replacement struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Rewrite replaces the request path, matched against a regular expression,
+// before it's proxied. The replacement may refer to submatches, e.g. $1.
+type Rewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// maxLineLength is the longest line ParseLines accepts.
+const maxLineLength = 1 << 20
+
+// ParseLines parses entries in the line format, one per line. Lines may end
+// in CRLF, and blank lines are ignored.
+func ParseLines(r io.Reader) ([]Entry, error) {
+	var (
+		entries []Entry
+		n       int // line number
+		s       = bufio.NewScanner(skipBOM(r))
+	)
+	s.Buffer(nil, maxLineLength)
+	for s.Scan() {
+		n++
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		e, err := parseLine(s.Text())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if s.Err() == bufio.ErrTooLong {
+		return nil, errors.Errorf("line %d is longer than %d bytes", n+1, maxLineLength)
+	}
+	return entries, s.Err()
+}
+
+// parseLine parses a config line of the form
+//
+//	host[, host...]: dest [option...]
+//
+// where each option is key or key=value. Double quotes may be used for
+// destinations or options containing whitespace. Hosts may have ports, e.g.
+// a.com:8080: 9000.
+func parseLine(line string) (Entry, error) {
+	i := hostsEnd(line)
+	if i < 0 {
+		return Entry{}, errors.Errorf("bad line: %s", line)
+	}
+	toks := []string{line[:i], line[i+1:]}
+	fields, err := splitFields(toks[1])
+	if err != nil {
+		return Entry{}, errors.Wrapf(err, "bad line: %s", line)
+	}
+	if len(fields) == 0 {
+		return Entry{}, errors.Errorf("bad line: %s", line)
+	}
+	var e Entry
+	if !isOption(fields[0]) {
+		e.Dest, fields = fields[0], fields[1:] // the destination is optional, e.g. for redirects
+	}
+	for _, host := range strings.Split(toks[0], ",") {
+		e.Hosts = append(e.Hosts, strings.TrimSpace(host))
+	}
+	for _, option := range fields {
+		if err := e.setOption(option); err != nil {
+			return Entry{}, errors.Wrapf(err, "bad line: %s", line)
+		}
+	}
+	return e, nil
+}
+
+// hostsEnd returns the index of the colon after the hosts in a config line:
+// the first followed by whitespace, as hosts may have ports, or else the
+// first, for lines like a.com:8080. It returns -1 if there's no colon.
+func hostsEnd(line string) int {
+	for i := 0; i < len(line); i++ {
+		if line[i] == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t') {
+			return i
+		}
+	}
+	return strings.Index(line, ":")
+}
+
+// isOption reports whether the field looks like key=value, with a key made of
+// lowercase letters and hyphens, rather than a destination.
+func isOption(field string) bool {
+	i := strings.Index(field, "=")
+	if i <= 0 {
+		return false
+	}
+	for _, r := range field[:i] {
+		if (r < 'a' || r > 'z') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// splitFields splits s around whitespace, like strings.Fields, except that
+// double-quoted sections are kept intact, without the quotes. Within quotes, a
+// backslash escapes the following character.
+func splitFields(s string) ([]string, error) {
+	var (
+		fields  []string
+		field   strings.Builder
+		inField bool
+		quoted  bool
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted, inField = !quoted, true
+		case !quoted && unicode.IsSpace(r):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// skipBOM returns a reader of r without any leading UTF-8 byte order mark,
+// which some Windows editors add to text files.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(3); err == nil && string(b) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	return br
+}
+
+// ParseJSON parses a JSON array of entries.
+func ParseJSON(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	dec := json.NewDecoder(skipBOM(r))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, errors.Wrap(err, "JSON decode failed")
+	}
+	for i, e := range entries {
+		if len(e.Hosts) == 0 || (e.Dest == "" && e.Redirect == "") {
+			return nil, errors.Errorf("entry %d: hosts and dest are required", i+1)
+		}
+	}
+	return entries, nil
+}
+
+func (e *Entry) setOption(option string) (err error) {
+	key, value := option, ""
+	if i := strings.Index(option, "="); i >= 0 {
+		key, value = option[:i], option[i+1:]
+	}
+	switch key {
+	case "listeners":
+		e.Listeners = append(e.Listeners, splitList(value)...)
+	case "strip-header":
+		e.StripHeader = append(e.StripHeader, splitList(value)...)
+	case "strip-response-header":
+		e.StripResponseHeader = append(e.StripResponseHeader, splitList(value)...)
+	case "headers-file":
+		e.HeadersFile = value
+	case "allow-status":
+		e.AllowStatus = append(e.AllowStatus, splitList(value)...)
+	case "spa":
+		e.SPA, err = parseBool(value)
+	case "forward-client-port":
+		e.ForwardClientPort, err = parseBool(value)
+	case "forward-host":
+		e.ForwardHost, err = parseBool(value)
+	case "content-type":
+		e.ContentType = value
+	case "redirect":
+		e.Redirect = value
+	case "redirect-status":
+		e.RedirectStatus, err = strconv.Atoi(value)
+	case "preserve-path":
+		e.PreservePath, err = parseBool(value)
+	case "rewrite":
+		toks := strings.SplitN(value, "=", 2)
+		if len(toks) != 2 {
+			return errors.Errorf("%s: want pattern=replacement", key)
+		}
+		e.Rewrite = &Rewrite{Pattern: toks[0], Replacement: toks[1]}
+	case "add-query", "set-query":
+		name, v, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return errors.Errorf("%s: want name=value", key)
+		}
+		if key == "add-query" {
+			e.AddQuery = append(e.AddQuery, QueryParam{Name: name, Value: v})
+		} else {
+			e.SetQuery = append(e.SetQuery, QueryParam{Name: name, Value: v})
+		}
+	case "strip-query":
+		e.StripQuery = append(e.StripQuery, splitList(value)...)
+	case "replace":
+		toks := strings.SplitN(value, "=", 2)
+		if len(toks) != 2 || toks[0] == "" {
+			return errors.Errorf("%s: want old=new", key)
+		}
+		e.Replace = append(e.Replace, Replacement{Old: toks[0], New: toks[1]})
+	case "cookie-domain":
+		toks := strings.SplitN(value, "=", 2)
+		if len(toks) != 2 || toks[0] == "" {
+			return errors.Errorf("%s: want backend-domain=public-domain, or backend-domain= to remove it", key)
+		}
+		e.CookieDomain = append(e.CookieDomain, Replacement{Old: toks[0], New: toks[1]})
+	case "cookie-path":
+		toks := strings.SplitN(value, "=", 2)
+		if len(toks) != 2 || !strings.HasPrefix(toks[0], "/") || !strings.HasPrefix(toks[1], "/") {
+			return errors.Errorf("%s: want /backend-path=/public-path", key)
+		}
+		e.CookiePath = append(e.CookiePath, Replacement{Old: toks[0], New: toks[1]})
+	case "cache":
+		toks := strings.SplitN(value, "=", 2)
+		if len(toks) != 2 || !validCachePattern(toks[0]) {
+			return errors.Errorf("%s: want pattern=value, with a pattern of /prefix, .ext, or *", key)
+		}
+		e.Cache = append(e.Cache, CacheRule{Pattern: toks[0], Value: toks[1]})
+	case "timeout":
+		e.Timeout = value
+	case "header-timeout":
+		e.HeaderTimeout = value
+	case "write-timeout":
+		e.WriteTimeout = value
+	case "websocket-idle-timeout":
+		e.WebSocketIdleTimeout = value
+	case "timeout-page":
+		e.TimeoutPage = value
+	case "disable-upstream-keepalive":
+		e.DisableUpstreamKeepAlive, err = parseBool(value)
+	case "via":
+		e.Via = value
+	case "authfile":
+		e.AuthFile = value
+	case "upstream-auth":
+		e.UpstreamAuth = value
+	case "fallback":
+		e.Fallback = value
+	case "debug-body":
+		e.DebugBody, err = strconv.Atoi(value)
+	case "buffer":
+		e.Buffer, err = strconv.Atoi(value)
+	case "gzip":
+		e.Gzip, err = parseBool(value)
+	case "gzip-level":
+		e.GzipLevel, err = strconv.Atoi(value)
+	case "nogzip":
+		e.NoGzip = append(e.NoGzip, splitList(value)...)
+	case "chunked":
+		e.Chunked = value
+	case "sni":
+		e.SNI = value
+	case "canary":
+		i := strings.LastIndex(value, ":")
+		if i < 0 {
+			return errors.Errorf("%s: want dest:percent%%", key)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value[i+1:], "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return errors.Errorf("%s: invalid percentage %s", key, value[i+1:])
+		}
+		if e.Canary == nil {
+			e.Canary = &Canary{}
+		}
+		e.Canary.Dest, e.Canary.Percent = value[:i], percent
+	case "canary-sticky":
+		if e.Canary == nil {
+			e.Canary = &Canary{}
+		}
+		e.Canary.Sticky, err = parseBool(value)
+	default:
+		return errors.Errorf("unknown option %q", key)
+	}
+	return errors.Wrap(err, key)
+}
+
+// splitList splits a comma-separated option value, dropping empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// parseBool parses a boolean option value. A bare option, with no value, is
+// true.
+func parseBool(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLinesLongLine(t *testing.T) {
+	var (
+		long    = "a.com: 8080 strip-header=" + strings.Repeat("X", 100_000) + "\nb.com: 8081\n"
+		tooLong = "a.com: 8080\nb.com: 8081 strip-header=" + strings.Repeat("X", maxLineLength) + "\n"
+		entries []Entry
+		err     error
+	)
+	if entries, err = ParseLines(strings.NewReader(long)); err != nil {
+		t.Fatalf("line of 100 KB: %v", err)
+	}
+	if len(entries) != 2 || len(entries[0].StripHeader[0]) != 100_000 || entries[1].Dest != "8081" {
+		t.Error("line of 100 KB: entries not parsed in full")
+	}
+	_, err = ParseLines(strings.NewReader(tooLong))
+	if err == nil {
+		t.Fatal("line over 1 MiB: want error, have none")
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("line over 1 MiB: want error for line 2, have %v", err)
+	}
+}
+
+func TestParseBOMAndCRLF(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	for name, config := range map[string]string{
+		"LF":             "a.com: 8080\nb.com, c.com: 8081 forward-host\n",
+		"CRLF":           "a.com: 8080\r\nb.com, c.com: 8081 forward-host\r\n",
+		"BOM":            bom + "a.com: 8080\nb.com, c.com: 8081 forward-host\n",
+		"BOM CRLF":       bom + "a.com: 8080\r\nb.com, c.com: 8081 forward-host\r\n",
+		"blank lines":    "\r\n  \na.com: 8080\n\t\r\nb.com, c.com: 8081 forward-host\n\n",
+		"no final EOL":   "a.com: 8080\r\nb.com, c.com: 8081 forward-host",
+		"trailing space": "a.com: 8080  \r\nb.com, c.com: 8081 forward-host \t\r\n",
+	} {
+		entries, err := ParseLines(strings.NewReader(config))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(entries) != 2 {
+			t.Errorf("%s: want 2 entries, have %d", name, len(entries))
+			continue
+		}
+		a, b := entries[0], entries[1]
+		if len(a.Hosts) != 1 || a.Hosts[0] != "a.com" || a.Dest != "8080" {
+			t.Errorf("%s: first entry: have hosts %q, dest %q", name, a.Hosts, a.Dest)
+		}
+		if len(b.Hosts) != 2 || b.Hosts[1] != "c.com" || b.Dest != "8081" || !b.ForwardHost {
+			t.Errorf("%s: second entry: have hosts %q, dest %q, forward-host %v", name, b.Hosts, b.Dest, b.ForwardHost)
+		}
+	}
+
+	for name, config := range map[string]string{
+		"JSON":      `[{"hosts": ["a.com"], "dest": "8080"}]`,
+		"JSON BOM":  bom + `[{"hosts": ["a.com"], "dest": "8080"}]`,
+		"JSON CRLF": bom + "[\r\n  {\"hosts\": [\"a.com\"], \"dest\": \"8080\"}\r\n]\r\n",
+	} {
+		entries, err := ParseJSON(strings.NewReader(config))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(entries) != 1 || entries[0].Dest != "8080" {
+			t.Errorf("%s: have %+v", name, entries)
+		}
+	}
+}
+
+func TestParseLineHosts(t *testing.T) {
+	for line, want := range map[string]struct {
+		hosts []string
+		dest  string
+	}{
+		"a.com: 9000":                   {[]string{"a.com"}, "9000"},
+		"a.com:9000":                    {[]string{"a.com"}, "9000"},
+		"a.com:8080: 9000":              {[]string{"a.com:8080"}, "9000"},
+		"a.com:8080:\t9000":             {[]string{"a.com:8080"}, "9000"},
+		"a.com:8080, b.com: 9000":       {[]string{"a.com:8080", "b.com"}, "9000"},
+		"a.com: text:200:hello":         {[]string{"a.com"}, "text:200:hello"},
+		`a.com: "text:200:a: b"`:        {[]string{"a.com"}, "text:200:a: b"},
+		"a.com:8080: http://b.com:8081": {[]string{"a.com:8080"}, "http://b.com:8081"},
+	} {
+		e, err := parseLine(line)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		if strings.Join(e.Hosts, " ") != strings.Join(want.hosts, " ") || e.Dest != want.dest {
+			t.Errorf("%s: want %q -> %q, have %q -> %q", line, want.hosts, want.dest, e.Hosts, e.Dest)
+		}
+	}
+	if _, err := parseLine("a.com 9000"); err == nil {
+		t.Error("no colon: want error, have none")
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.conf":     "a.com: text:200:a\n",
+		"b.json":     `[{"hosts": ["b.com"], "dest": "text:200:b"}]`,
+		"c.conf.bak": "c.com: text:200:c\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := LoadDir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{"a.com": true, "b.com": true, "c.com": false} {
+		if _, have := cfg[host]; have != want {
+			t.Errorf("%s: want configured %v, have %v", host, want, have)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rewriteCookies rewrites the Domain and Path attributes of the Set-Cookie
+// headers in h, so cookies a backend scopes to its own domain or path work
+// under the public host. A Domain matching one of domains, ignoring case and
+// any leading dot, is replaced by its New value, or removed if that's empty,
+// making the cookie host-only. A Path equal to, or under, one of paths has
+// that prefix replaced by its New value.
+func rewriteCookies(h http.Header, domains, paths []Replacement) {
+	cookies := h["Set-Cookie"]
+	for i, cookie := range cookies {
+		attrs := strings.Split(cookie, ";")
+		rewritten := attrs[:1] // name=value
+		for _, attr := range attrs[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+			switch {
+			case strings.EqualFold(name, "Domain"):
+				if to, ok := rewriteDomain(value, domains); ok {
+					if to == "" {
+						continue
+					}
+					attr = " Domain=" + to
+				}
+			case strings.EqualFold(name, "Path"):
+				if to, ok := rewritePath(value, paths); ok {
+					attr = " Path=" + to
+				}
+			}
+			rewritten = append(rewritten, attr)
+		}
+		cookies[i] = strings.Join(rewritten, ";")
+	}
+}
+
+func rewriteDomain(domain string, domains []Replacement) (string, bool) {
+	domain = strings.TrimPrefix(domain, ".")
+	for _, d := range domains {
+		if strings.EqualFold(domain, strings.TrimPrefix(d.Old, ".")) {
+			return d.New, true
+		}
+	}
+	return "", false
+}
+
+func rewritePath(path string, paths []Replacement) (string, bool) {
+	for _, p := range paths {
+		prefix := strings.TrimSuffix(p.Old, "/")
+		if path == p.Old || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			rest := strings.TrimPrefix(path, prefix)
+			to := strings.TrimSuffix(p.New, "/") + rest
+			if to == "" {
+				to = "/"
+			}
+			return to, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// debugTransport logs the headers of each request sent to the backend, and of
+// each response received, after all other modifications have been made.
+type debugTransport struct {
+	next   http.RoundTripper
+	redact map[string]bool // canonical header names
+}
+
+func (t *debugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	log.Printf("debug %s %s %s request headers: %s", r.Host, r.Method, r.URL, t.format(r.Header))
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("debug %s %s %s response %d headers: %s", r.Host, r.Method, r.URL, resp.StatusCode, t.format(resp.Header))
+	return resp, nil
+}
+
+func (t *debugTransport) format(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range h[name] {
+			if t.redact[name] {
+				value = "REDACTED"
+			}
+			pairs = append(pairs, name+": "+value)
+		}
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// debugBody wraps the body of r, which is forwarded in full, to log up to max
+// bytes of it once it's been sent and closed.
+func debugBody(r *http.Request, max int) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	b := &bodyLogger{
+		closer: r.Body,
+		buf:    &cappedBuffer{max: max},
+		prefix: fmt.Sprintf("debug %s %s %s", r.Host, r.Method, r.URL),
+	}
+	b.Reader = io.TeeReader(r.Body, b.buf)
+	r.Body = b
+}
+
+type bodyLogger struct {
+	io.Reader
+	closer io.Closer
+	buf    *cappedBuffer
+	prefix string
+	once   sync.Once
+}
+
+func (b *bodyLogger) Close() error {
+	b.once.Do(func() {
+		more := ""
+		if b.buf.dropped > 0 {
+			more = fmt.Sprintf(", %d more not shown", b.buf.dropped)
+		}
+		log.Printf("%s request body (%d bytes%s): %q", b.prefix, b.buf.Len(), more, b.buf.Bytes())
+	})
+	return b.closer.Close()
+}
+
+// cappedBuffer keeps the first max bytes written to it, and counts the rest.
+// Writes always succeed, so a TeeReader writing to it never fails.
+type cappedBuffer struct {
+	bytes.Buffer
+	max     int
+	dropped int
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	n := min(len(p), c.max-c.Len())
+	c.Buffer.Write(p[:n])
+	c.dropped += len(p) - n
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewTransport returns a base transport for reverse proxies. If
+// resolverAddr is non-empty, backend hostnames are resolved by querying that
+// DNS server directly, rather than via the system resolver. If ttl is
+// non-zero, DNS results are cached for that long.
+func NewTransport(resolverAddr string, ttl time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if resolverAddr != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolverAddr)
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if ttl > 0 {
+		transport.DialContext = newDNSCache(dialer, ttl).DialContext
+	}
+	return transport
+}
+
+// dnsCache dials with cached DNS results, so hostnames aren't resolved on
+// every dial.
+type dnsCache struct {
+	dialer *net.Dialer
+	ttl    time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(dialer *net.Dialer, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		dialer:  dialer,
+		ttl:     ttl,
+		entries: map[string]dnsEntry{},
+	}
+}
+
+// DialContext resolves the host in addr, from the cache if possible, and dials
+// each of its addresses in turn until one succeeds.
+func (c *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mtx.Lock()
+	e, ok := c.entries[host]
+	c.mtx.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	resolver := c.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mtx.Unlock()
+	return addrs, nil
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dirCheck serves 503 Service Unavailable, rather than confusing 404s, while
+// the directory of a file server is unavailable, e.g. because its volume was
+// unmounted. The directory is checked periodically via Configuration.Check.
+type dirCheck struct {
+	dir        string
+	retryAfter time.Duration
+	next       http.Handler
+	available  atomic.Bool
+}
+
+func newDirCheck(dir string, retryAfter time.Duration, next http.Handler) *dirCheck {
+	d := &dirCheck{dir: dir, retryAfter: retryAfter, next: next}
+	d.available.Store(true)
+	return d
+}
+
+func (d *dirCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !d.available.Load() {
+		if d.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.retryAfter.Seconds()))))
+		}
+		http.Error(w, "directory unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	d.next.ServeHTTP(w, r)
+}
+
+// check updates the availability of the directory, logging any change.
+func (d *dirCheck) check() {
+	available := readable(d.dir)
+	if prev := d.available.Swap(available); prev != available {
+		if available {
+			log.Printf("directory %s is available again", d.dir)
+		} else {
+			log.Printf("directory %s is unavailable, serving 503", d.dir)
+		}
+	}
+}
+
+// readable reports whether dir exists and its entries can be read.
+func readable(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return false
+	}
+	return true
+}
+
+// cacheControl sets the Cache-Control header of successful responses, and 304
+// Not Modified, from the first rule matching the request path.
+func cacheControl(rules []CacheRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range rules {
+			if matchCachePattern(c.Pattern, r.URL.Path) {
+				w = &cacheWriter{ResponseWriter: w, value: c.Value}
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validCachePattern(pattern string) bool {
+	return pattern == "*" || (len(pattern) > 1 && (pattern[0] == '/' || pattern[0] == '.'))
+}
+
+func matchCachePattern(pattern, urlPath string) bool {
+	switch pattern[0] {
+	case '/':
+		return strings.HasPrefix(urlPath, pattern)
+	case '.':
+		return path.Ext(urlPath) == pattern
+	default:
+		return true
+	}
+}
+
+// cacheWriter sets Cache-Control when the status is known, so errors aren't
+// cached as long as the files.
+type cacheWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < 300 || code == http.StatusNotModified {
+			w.Header().Set("Cache-Control", w.value)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the underlying ResponseWriter's sendfile, as in statusWriter.
+func (w *cacheWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// spa serves the root's index.html for requests that don't match a file and
+// don't have an extension, so client-side routing works in single-page apps.
+// Missing assets, which have extensions, still 404.
+func spa(root string, next http.Handler) http.Handler {
+	dir := http.Dir(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := path.Clean("/" + r.URL.Path); path.Ext(p) == "" {
+			if f, err := dir.Open(p); os.IsNotExist(err) {
+				http.ServeFile(w, r, filepath.Join(root, "index.html"))
+				return
+			} else if err == nil {
+				f.Close()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxReplaceSize is the largest HTML file that replaceHTML will modify. Larger
+// files are served unmodified.
+const maxReplaceSize = 1 << 20
+
+// replaceHTML applies the replacer to complete (200 OK) text/html responses
+// from next, up to maxReplaceSize. Those responses are buffered in memory;
+// all others are passed through as they're written.
+func replaceHTML(replacer *strings.Replacer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &replaceWriter{ResponseWriter: w, replacer: replacer}
+		if r.Method == http.MethodHead {
+			// Generate the body anyway, so Content-Length is correct.
+			r = r.Clone(r.Context())
+			r.Method = http.MethodGet
+			rw.head = true
+		}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+type replaceWriter struct {
+	http.ResponseWriter
+	replacer    *strings.Replacer
+	head        bool
+	wroteHeader bool
+	code        int
+	buf         *bytes.Buffer // non-nil if the response is being buffered
+}
+
+func (w *replaceWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && n <= maxReplaceSize {
+			w.code, w.buf = code, &bytes.Buffer{}
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *replaceWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(p)
+	}
+	if w.head {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *replaceWriter) finish() {
+	if w.buf == nil {
+		return
+	}
+	body := w.replacer.Replace(w.buf.String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.code)
+	if !w.head {
+		io.WriteString(w.ResponseWriter, body)
+	}
+}
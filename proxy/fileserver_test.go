@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileServerHEAD(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html": "<html><head></head><body>app</body></html>",
+		"style.css":  "body { color: red; }",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandler(t, []Entry{{
+		Hosts:   []string{"a.com"},
+		Dest:    dir,
+		SPA:     true,
+		Cache:   []CacheRule{{Pattern: ".css", Value: "max-age=60"}},
+		Replace: []Replacement{{Old: "</head>", New: "<script>1</script></head>"}},
+	}})
+
+	// /index.html redirects to /.
+	for _, path := range []string{"/", "/index.html", "/style.css", "/some/route"} {
+		serve := func(method string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, path, nil)
+			req.Host = "a.com"
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+		get, head := serve("GET"), serve("HEAD")
+		if head.Code != get.Code {
+			t.Errorf("%s: HEAD status %d, GET %d", path, head.Code, get.Code)
+		}
+		for _, name := range []string{"Content-Length", "Content-Type", "Cache-Control", "Last-Modified"} {
+			if h, g := head.Header().Get(name), get.Header().Get(name); h != g {
+				t.Errorf("%s: HEAD %s %q, GET %q", path, name, h, g)
+			}
+		}
+		if n := head.Body.Len(); n > 0 {
+			t.Errorf("%s: HEAD wrote %d bytes of body", path, n)
+		}
+		if get.Code == http.StatusOK && get.Body.Len() == 0 {
+			t.Errorf("%s: GET wrote no body", path)
+		}
+	}
+}
+
+func TestWriteTimeoutLargeFile(t *testing.T) {
+	dir := t.TempDir()
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(dir, "large.bin"))
+	if err == nil {
+		err = f.Truncate(size)
+		f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, []Entry{
+		{Hosts: []string{"default.com"}, Dest: dir},
+		{Hosts: []string{"unlimited.com"}, Dest: dir, WriteTimeout: "0"},
+		{Hosts: []string{"long.com"}, Dest: dir, WriteTimeout: "1m"},
+	})
+	server := httptest.NewUnstartedServer(h)
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	for host, complete := range map[string]bool{
+		"default.com":   false,
+		"unlimited.com": true,
+		"long.com":      true,
+	} {
+		t.Run(host, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", server.URL+"/large.bin", nil)
+			req.Host = host
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			// Read slowly, so the download takes longer than the server's
+			// write timeout.
+			var n int64
+			buf := make([]byte, 1<<20)
+			for {
+				m, err := io.ReadFull(resp.Body, buf)
+				n += int64(m)
+				if err != nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if (n == size) != complete {
+				t.Errorf("want complete %v, have %d of %d bytes", complete, n, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minGzipSize is the smallest response, by Content-Length, that's worth
+// compressing. Responses of unknown length are always compressed.
+const minGzipSize = 1024
+
+// gzipResponse compresses the body of resp with gzip, if the client accepts
+// it, the backend didn't already encode it, and its Content-Type is text, and
+// not one of exclude. Range requests and partial responses are left alone, as
+// the byte ranges refer to the uncompressed body. A level of 0 is
+// gzip.DefaultCompression.
+func gzipResponse(resp *http.Response, level int, exclude []string) {
+	switch {
+	case resp.Request.Method == http.MethodHead, resp.Request.Header.Get("Range") != "":
+		return
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return
+	case resp.StatusCode == http.StatusPartialContent, resp.Header.Get("Content-Range") != "":
+		return
+	case resp.Header.Get("Content-Encoding") != "":
+		return
+	case resp.ContentLength >= 0 && resp.ContentLength < minGzipSize:
+		return
+	case !acceptsGzip(resp.Request.Header) || !compressible(resp.Header.Get("Content-Type"), exclude):
+		return
+	}
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges") // ranges of the compressed body aren't served
+	resp.ContentLength = -1
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag) // the compressed body isn't byte-identical
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	resp.Body = gzipBody(resp.Body, level)
+}
+
+// gzipBody returns a reader of body compressed with gzip at the level, which
+// must be valid. Closing it closes body.
+func gzipBody(body io.ReadCloser, level int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz, err := gzip.NewWriterLevel(pw, level)
+		if err == nil {
+			_, err = io.Copy(gz, body)
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return struct {
+		io.Reader
+		io.Closer
+	}{pr, closers{pr, body}}
+}
+
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var err error
+	for _, closer := range c {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip, by
+// name or as *, without a q-value of 0.
+func acceptsGzip(h http.Header) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			q := 1.0
+			if s, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(s, 64); err == nil {
+					q = f
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip":
+				gzipQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// compressible reports whether responses of the content type are text, which
+// gzip compresses well, rather than e.g. images, which are compressed already.
+// Server-sent events aren't, as compression would hold them back, and nor are
+// the types in exclude.
+func compressible(contentType string, exclude []string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, x := range exclude {
+		if strings.EqualFold(t, x) {
+			return false
+		}
+	}
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/javascript", "application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGzipProxied(t *testing.T) {
+	text := strings.Repeat("hello, world\n", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, text)
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, Gzip: true}}))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "a.com"
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("want Content-Encoding gzip, have %q", ce)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Errorf("want no Content-Length, have %d", resp.ContentLength)
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("want Vary Accept-Encoding, have %q", vary)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `W/"v1"` {
+		t.Errorf(`want ETag W/"v1", have %s`, etag)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != text {
+		t.Errorf("want the backend's %d bytes, have %d", len(text), len(body))
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	text := strings.Repeat("x", 2*minGzipSize)
+	for _, test := range []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		code           int
+		header         http.Header
+		contentLength  int64
+		want           bool
+	}{
+		{"text", "GET", "gzip", 200, http.Header{"Content-Type": {"text/html"}}, int64(len(text)), true},
+		{"unknown length", "GET", "gzip", 200, http.Header{"Content-Type": {"application/json"}}, -1, true},
+		{"q-values", "GET", "br;q=1, gzip;q=0.5", 200, http.Header{"Content-Type": {"text/css"}}, -1, true},
+		{"any", "GET", "*", 200, http.Header{"Content-Type": {"text/css"}}, -1, true},
+		{"not accepted", "GET", "br", 200, http.Header{"Content-Type": {"text/html"}}, -1, false},
+		{"gzip;q=0", "GET", "gzip;q=0, *", 200, http.Header{"Content-Type": {"text/html"}}, -1, false},
+		{"no Accept-Encoding", "GET", "", 200, http.Header{"Content-Type": {"text/html"}}, -1, false},
+		{"HEAD", "HEAD", "gzip", 200, http.Header{"Content-Type": {"text/html"}}, -1, false},
+		{"204", "GET", "gzip", 204, http.Header{"Content-Type": {"text/html"}}, -1, false},
+		{"304", "GET", "gzip", 304, http.Header{"Content-Type": {"text/html"}}, -1, false},
+		{"small", "GET", "gzip", 200, http.Header{"Content-Type": {"text/html"}}, minGzipSize - 1, false},
+		{"encoded", "GET", "gzip", 200, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}, -1, false},
+		{"image", "GET", "gzip", 200, http.Header{"Content-Type": {"image/png"}}, -1, false},
+		{"event stream", "GET", "gzip", 200, http.Header{"Content-Type": {"text/event-stream"}}, -1, false},
+		{"no Content-Type", "GET", "gzip", 200, http.Header{}, -1, false},
+		{"206", "GET", "gzip", 206, http.Header{"Content-Type": {"text/html"}, "Content-Range": {"bytes 0-2047/4096"}}, int64(len(text)), false},
+		{"Content-Range", "GET", "gzip", 200, http.Header{"Content-Type": {"text/html"}, "Content-Range": {"bytes 0-2047/2048"}}, int64(len(text)), false},
+	} {
+		req := httptest.NewRequest(test.method, "/", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		resp := &http.Response{
+			Request:       req,
+			StatusCode:    test.code,
+			Header:        test.header,
+			ContentLength: test.contentLength,
+			Body:          io.NopCloser(strings.NewReader(text)),
+		}
+		gzipResponse(resp, 0, nil)
+		if have := resp.Header.Get("Content-Encoding") == "gzip"; have != test.want {
+			t.Errorf("%s: want compressed %v, have %v", test.name, test.want, have)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestGzipRange(t *testing.T) {
+	dir := t.TempDir()
+	text := strings.Repeat("0123456789", 1000)
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, Gzip: true}}))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(rangeHeader string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxy.URL+"/file.txt", nil)
+		req.Host = "a.com"
+		req.Header.Set("Accept-Encoding", "gzip")
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("bytes=10-19")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Range: want 206, have %d", resp.StatusCode)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Range: want no Content-Encoding, have %q", ce)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 10-19/10000" {
+		t.Errorf("Range: want Content-Range bytes 10-19/10000, have %q", cr)
+	}
+	if body != text[10:20] {
+		t.Errorf("Range: want %q, have %q", text[10:20], body)
+	}
+
+	resp, _ = get("")
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("full: want Content-Encoding gzip, have %q", ce)
+	}
+	if ar := resp.Header.Get("Accept-Ranges"); ar != "" {
+		t.Errorf("full: want no Accept-Ranges, have %q", ar)
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	text := strings.Repeat("0123456789", 1000)
+	// The gzip header's XFL byte records the fastest and smallest levels.
+	for level, xfl := range map[int]byte{0: 0, gzip.BestSpeed: 4, gzip.BestCompression: 2} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := &http.Response{
+			Request:       req,
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			ContentLength: -1,
+			Body:          io.NopCloser(strings.NewReader(text)),
+		}
+		gzipResponse(resp, level, nil)
+		compressed, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if have := compressed[8]; have != xfl {
+			t.Errorf("level %d: want XFL %d, have %d", level, xfl, have)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if body, err := io.ReadAll(gz); err != nil || string(body) != text {
+			t.Errorf("level %d: body doesn't round-trip (%v)", level, err)
+		}
+	}
+}
+
+func TestCompressibleExclude(t *testing.T) {
+	exclude := []string{"application/x-custom", "text/csv"}
+	for contentType, want := range map[string]bool{
+		"text/html":                   true,
+		"application/json":            true,
+		"text/csv":                    false,
+		"TEXT/CSV; charset=utf-8":     false,
+		"application/x-custom":        false,
+		"application/x-custom+json":   true,
+		"image/png":                   false,
+		"text/event-stream":           false,
+		"application/x-custom; v=2.0": false,
+	} {
+		if have := compressible(contentType, exclude); have != want {
+			t.Errorf("%s: want %v, have %v", contentType, want, have)
+		}
+	}
+}
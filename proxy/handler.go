@@ -0,0 +1,434 @@
+// Package proxy routes HTTP requests, based on their Host header, to reverse
+// proxies, file servers, and other targets loaded from a config file. It's the
+// core of the http-proxy command, and can be embedded in other programs.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Handler serves each request with the target configured for its Host. The
+// configuration may be replaced while the handler is in use.
+type Handler struct {
+	cfg         atomic.Value // Configuration
+	disabled    atomic.Value // map[string]time.Duration, hosts to Retry-After
+	canaries    atomic.Value // map[string]float64, hosts to canary percentages set at runtime
+	loaded      atomic.Value // time.Time cfg was set
+	mtx         sync.Mutex   // serializes changes to cfg, disabled, and canaries
+	requests    sync.Map     // host to *requestCounts, since the handler was created
+	unmatched   http.Handler
+	emptyHost   string
+	rejectEmpty bool
+	logSample   float64
+	logTLS      bool
+	forwardSNI  bool
+	logRule     bool
+	ruleHdr     string
+	accessLog   *log.Logger
+}
+
+// HandlerOption configures a Handler.
+type HandlerOption func(*Handler)
+
+// WithUnmatched sets the handler for requests to hosts that aren't configured.
+// By default, they get a 404.
+func WithUnmatched(unmatched http.Handler) HandlerOption {
+	return func(h *Handler) { h.unmatched = unmatched }
+}
+
+// WithEmptyHost serves requests without a Host header, e.g. from HTTP/1.0
+// clients, as if their Host were host. By default, they're treated as requests
+// to unconfigured hosts.
+func WithEmptyHost(host string) HandlerOption {
+	return func(h *Handler) { h.emptyHost = host }
+}
+
+// WithRejectEmptyHost responds 400 Bad Request to requests without a Host
+// header, rather than treating them as requests to unconfigured hosts.
+func WithRejectEmptyHost() HandlerOption {
+	return func(h *Handler) { h.rejectEmpty = true }
+}
+
+// WithLogSample sets the fraction of successful requests, from 0.0 to 1.0,
+// that are logged. Errors, i.e. responses with status 400 or above, are always
+// logged. By default, every request is logged.
+func WithLogSample(fraction float64) HandlerOption {
+	return func(h *Handler) { h.logSample = fraction }
+}
+
+// WithLogTLS adds the TLS version and cipher suite of requests received over
+// TLS to the access log, e.g. "TLS1.3 TLS_AES_128_GCM_SHA256".
+func WithLogTLS() HandlerOption {
+	return func(h *Handler) { h.logTLS = true }
+}
+
+// WithForwardSNI sends the TLS server name (SNI) requested by the client, which
+// may differ from the Host, to backends in the X-Forwarded-SNI header, and adds
+// it to the access log, e.g. "sni=example.com". The header is removed from
+// requests that don't have one, e.g. plain HTTP requests, so it can't be
+// spoofed.
+func WithForwardSNI() HandlerOption {
+	return func(h *Handler) { h.forwardSNI = true }
+}
+
+// WithLogRule adds the config rule that matched each request to the access
+// log: the configured host, and the path prefix, if any, e.g.
+// "example.com/api".
+func WithLogRule() HandlerOption {
+	return func(h *Handler) { h.logRule = true }
+}
+
+// WithRuleHeader sends the config rule that matched each request, as for
+// WithLogRule, in the named response header.
+func WithRuleHeader(name string) HandlerOption {
+	return func(h *Handler) { h.ruleHdr = name }
+}
+
+// WithAccessLog sets the logger for requests. By default, they're logged with
+// the standard logger.
+func WithAccessLog(logger *log.Logger) HandlerOption {
+	return func(h *Handler) { h.accessLog = logger }
+}
+
+// NewHandler returns a handler serving the configuration.
+func NewHandler(cfg Configuration, options ...HandlerOption) *Handler {
+	h := &Handler{
+		unmatched: http.NotFoundHandler(),
+		logSample: 1.0,
+		accessLog: log.Default(),
+	}
+	for _, option := range options {
+		option(h)
+	}
+	h.SetConfiguration(cfg)
+	return h
+}
+
+// Configuration returns the configuration currently in use.
+func (h *Handler) Configuration() Configuration {
+	return h.cfg.Load().(Configuration)
+}
+
+// SetConfiguration replaces the configuration. Requests in flight complete
+// with the old configuration. Every host is enabled, with its configured
+// canary percentage.
+func (h *Handler) SetConfiguration(cfg Configuration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.cfg.Store(cfg)
+	h.disabled.Store(map[string]time.Duration{})
+	h.canaries.Store(map[string]float64{})
+	h.loaded.Store(time.Now())
+}
+
+// Loaded returns when the configuration in use was set.
+func (h *Handler) Loaded() time.Time {
+	return h.loaded.Load().(time.Time)
+}
+
+// RequestCounts are the number of requests served for a host, and how many of
+// them got a server error, i.e. status 500 or above.
+type RequestCounts struct {
+	Total  uint64
+	Errors uint64
+}
+
+type requestCounts struct {
+	total, errors atomic.Uint64
+}
+
+// Requests returns the request counts of every host that's served requests
+// since the handler was created, including hosts no longer configured.
+func (h *Handler) Requests() map[string]RequestCounts {
+	requests := map[string]RequestCounts{}
+	h.requests.Range(func(host, c interface{}) bool {
+		counts := c.(*requestCounts)
+		requests[host.(string)] = RequestCounts{Total: counts.total.Load(), Errors: counts.errors.Load()}
+		return true
+	})
+	return requests
+}
+
+// count records a request served for host with status code.
+func (h *Handler) count(host string, code int) {
+	c, ok := h.requests.Load(host)
+	if !ok {
+		c, _ = h.requests.LoadOrStore(host, &requestCounts{})
+	}
+	counts := c.(*requestCounts)
+	counts.total.Add(1)
+	if code >= 500 {
+		counts.errors.Add(1)
+	}
+}
+
+// Disable takes a configured host out of service: requests for it get 503
+// Service Unavailable, with a Retry-After header, until it's enabled again or
+// the configuration is replaced.
+func (h *Handler) Disable(host string, retryAfter time.Duration) error {
+	return h.setDisabled(host, func(disabled map[string]time.Duration) {
+		disabled[host] = retryAfter
+	})
+}
+
+// Enable puts a host that was disabled back in service.
+func (h *Handler) Enable(host string) error {
+	return h.setDisabled(host, func(disabled map[string]time.Duration) {
+		delete(disabled, host)
+	})
+}
+
+// Disabled returns the disabled hosts, and the Retry-After for each.
+func (h *Handler) Disabled() map[string]time.Duration {
+	return h.disabled.Load().(map[string]time.Duration)
+}
+
+// SetCanary sets the percentage, from 0 to 100, of a host's requests that are
+// sent to its canary backend, in place of the configured percentage, until the
+// configuration is replaced.
+func (h *Handler) SetCanary(host string, percent float64) error {
+	if percent < 0 || percent > 100 {
+		return errors.Errorf("invalid percentage %v, want 0 to 100", percent)
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	target, ok := h.Configuration()[host]
+	if !ok {
+		return errors.Errorf("host %s not configured", host)
+	}
+	if !target.canary {
+		return errors.Errorf("host %s has no canary", host)
+	}
+	canaries := map[string]float64{}
+	for host, percent := range h.Canaries() {
+		canaries[host] = percent
+	}
+	canaries[host] = percent
+	h.canaries.Store(canaries)
+	return nil
+}
+
+// Canaries returns the hosts whose canary percentage was set with SetCanary,
+// and the percentage for each.
+func (h *Handler) Canaries() map[string]float64 {
+	return h.canaries.Load().(map[string]float64)
+}
+
+func (h *Handler) setDisabled(host string, update func(map[string]time.Duration)) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if _, ok := h.Configuration()[host]; !ok {
+		return errors.Errorf("host %s not configured", host)
+	}
+	disabled := map[string]time.Duration{}
+	for host, retryAfter := range h.Disabled() {
+		disabled[host] = retryAfter
+	}
+	update(disabled)
+	h.disabled.Store(disabled)
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions && r.RequestURI == "*" {
+		// A request about the server itself, rather than any host. net/http
+		// answers these before calling the handler, unless the server has
+		// DisableGeneralOptionsHandler set.
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, POST, PUT, PATCH, DELETE")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	defer h.recoverPanic(sw, r)
+	var rt routing
+	r = r.WithContext(context.WithValue(r.Context(), routingKey{}, &rt))
+	if r.Host == "" {
+		if h.rejectEmpty {
+			http.Error(sw, "missing Host header", http.StatusBadRequest)
+			h.accessLog.Printf("%s (%s) -> missing Host header 400", r.RemoteAddr, r.URL.Path)
+			return
+		}
+		r.Host = h.emptyHost // r is already a copy
+	}
+	var tlsInfo string
+	if h.logTLS && r.TLS != nil {
+		tlsInfo = " " + strings.ReplaceAll(tls.VersionName(r.TLS.Version), " ", "") + " " + tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	if h.forwardSNI {
+		r.Header.Del("X-Forwarded-SNI")
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			r.Header.Set("X-Forwarded-SNI", r.TLS.ServerName)
+			tlsInfo += " sni=" + r.TLS.ServerName
+		}
+	}
+	host, target, ok := h.lookup(r.Host)
+	if !ok || !target.serves(r) {
+		h.accessLog.Printf("%s %s (%s) -> not configured%s", r.RemoteAddr, r.Host, r.URL.Path, tlsInfo)
+		h.unmatched.ServeHTTP(sw, r)
+		return
+	}
+	if percent, ok := h.Canaries()[host]; ok {
+		rt.canary = &percent
+	}
+	if h.ruleHdr != "" {
+		sw.beforeHeader = func() { sw.Header().Set(h.ruleHdr, host+rt.prefix) }
+	}
+	if retryAfter, ok := h.Disabled()[host]; ok {
+		sw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		http.Error(sw, "host disabled", http.StatusServiceUnavailable)
+	} else {
+		target.ServeHTTP(sw, r)
+	}
+	h.count(host, sw.code)
+	backend := rt.backend
+	if backend == "" {
+		backend = target.Dest
+	}
+	var ruleInfo string
+	if h.logRule {
+		ruleInfo = " rule=" + host + rt.prefix
+	}
+	if sw.code >= 400 || h.logSample >= 1 || rand.Float64() < h.logSample {
+		h.accessLog.Printf("%s %s (%s) -> %s %d%s%s", r.RemoteAddr, r.Host, r.URL.Path, backend, sw.code, ruleInfo, tlsInfo)
+	}
+}
+
+// routing records the choices made by targets that route requests between
+// several backends or path prefixes, for the access log.
+type routing struct {
+	backend string
+	prefix  string
+	canary  *float64 // the canary percentage set with SetCanary, if any
+}
+
+// routingKey is the context key for the routing of a request.
+type routingKey struct{}
+
+// setBackend records the backend chosen to serve r.
+func setBackend(r *http.Request, backend string) {
+	if rt, ok := r.Context().Value(routingKey{}).(*routing); ok {
+		rt.backend = backend
+	}
+}
+
+// canaryPercent returns the canary percentage set for r's host with
+// SetCanary, or else percent.
+func canaryPercent(r *http.Request, percent float64) float64 {
+	if rt, ok := r.Context().Value(routingKey{}).(*routing); ok && rt.canary != nil {
+		return *rt.canary
+	}
+	return percent
+}
+
+// setPrefix records the path prefix r was routed by.
+func setPrefix(r *http.Request, prefix string) {
+	if rt, ok := r.Context().Value(routingKey{}).(*routing); ok {
+		rt.prefix = prefix
+	}
+}
+
+// lookup returns the configured host, and its target, matching the Host
+// header of a request. A host configured with a port must match exactly;
+// otherwise any port is ignored. IPv6 literals are configured without
+// brackets.
+func (h *Handler) lookup(hostport string) (string, Target, bool) {
+	cfg := h.Configuration()
+	if target, ok := cfg[hostport]; ok {
+		return hostport, target, true
+	}
+	host := hostport
+	if name, _, err := net.SplitHostPort(hostport); err == nil {
+		host = name
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	target, ok := cfg[host]
+	return host, target, ok
+}
+
+// recoverPanic logs a panic from a target, and responds 500 if it can. If the
+// response was already started, the connection is aborted instead, so the
+// client sees the response is incomplete. http.ErrAbortHandler is a
+// deliberate abort, and is passed on as is.
+func (h *Handler) recoverPanic(w *statusWriter, r *http.Request) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	log.Printf("%s %s (%s) -> panic: %v\n%s", r.RemoteAddr, r.Host, r.URL.Path, err, debug.Stack())
+	if w.code != 0 {
+		panic(http.ErrAbortHandler)
+	}
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+// statusWriter records the status code of the response. A code of 0 means no
+// response was written through it, e.g. because the connection was hijacked.
+// If beforeHeader is set, it's called before the response headers are
+// written, so it can add to them.
+type statusWriter struct {
+	http.ResponseWriter
+	code         int
+	beforeHeader func()
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 && code >= 200 {
+		if w.beforeHeader != nil {
+			w.beforeHeader()
+		}
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.implicitHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom lets io.Copy, e.g. in http.FileServer, reach the underlying
+// ResponseWriter's ReadFrom, which sends files with sendfile.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.implicitHeader()
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+}
+
+// implicitHeader records the 200 that writing the body without a status
+// implies.
+func (w *statusWriter) implicitHeader() {
+	if w.code == 0 {
+		if w.beforeHeader != nil {
+			w.beforeHeader()
+		}
+		w.code = http.StatusOK
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// ResponseWriter, e.g. to flush or hijack.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
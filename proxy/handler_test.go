@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHandler returns a handler serving the entries.
+func newTestHandler(t *testing.T, entries []Entry, options ...HandlerOption) *Handler {
+	t.Helper()
+	cfg, err := NewConfiguration(entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(cfg, options...)
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			http.Error(w, "no", http.StatusForbidden) // without reading the body
+			return
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		io.WriteString(w, strings.Repeat("x", int(n)))
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL}}))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	const size = 1 << 20
+	for path, want := range map[string]struct {
+		code int
+		read int64
+	}{
+		"/reject": {http.StatusForbidden, 0},
+		"/accept": {http.StatusOK, size},
+	} {
+		body := &countingReader{r: strings.NewReader(strings.Repeat("x", size))}
+		req, _ := http.NewRequest("POST", proxy.URL+path, body)
+		req.Host = "a.com"
+		req.ContentLength = size
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want.code {
+			t.Errorf("%s: want %d, have %d", path, want.code, resp.StatusCode)
+		}
+		if n := body.n.Load(); n != want.read {
+			t.Errorf("%s: want %d bytes of the body sent, have %d", path, want.read, n)
+		}
+	}
+}
+
+func TestClientDisconnectCancelsBackend(t *testing.T) {
+	var (
+		started  = make(chan struct{}, 1)
+		canceled = make(chan struct{}, 1)
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	for _, timeout := range []string{"", "10s"} {
+		t.Run("timeout="+timeout, func(t *testing.T) {
+			h := newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, Timeout: timeout}})
+			proxy := httptest.NewServer(h)
+			defer proxy.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, "GET", proxy.URL, nil)
+			req.Host = "a.com"
+			go func() {
+				<-started
+				cancel()
+			}()
+			if _, err := http.DefaultClient.Do(req); err == nil {
+				t.Fatal("want error, have none")
+			}
+			select {
+			case <-canceled:
+			case <-time.After(2 * time.Second):
+				t.Error("backend request wasn't canceled")
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	h := newTestHandler(t, []Entry{
+		{Hosts: []string{"a.com"}, Dest: "text:200:a"},
+		{Hosts: []string{"a.com:8080"}, Dest: "text:200:a8080"},
+		{Hosts: []string{"127.0.0.1"}, Dest: "text:200:v4"},
+		{Hosts: []string{"::1"}, Dest: "text:200:v6"},
+		{Hosts: []string{"[::1]:8443"}, Dest: "text:200:v6-8443"},
+	})
+	for hostport, want := range map[string]string{
+		"a.com":          "a.com",
+		"a.com:80":       "a.com",
+		"a.com:443":      "a.com",
+		"a.com:8080":     "a.com:8080",
+		"127.0.0.1":      "127.0.0.1",
+		"127.0.0.1:8080": "127.0.0.1",
+		"[::1]":          "::1",
+		"[::1]:8080":     "::1",
+		"[::1]:8443":     "[::1]:8443",
+		"b.com":          "",
+		"b.com:8080":     "",
+		"[::2]:8080":     "",
+	} {
+		host, _, ok := h.lookup(hostport)
+		switch {
+		case want == "" && ok:
+			t.Errorf("%s: want no match, have %s", hostport, host)
+		case want != "" && !ok:
+			t.Errorf("%s: want %s, have no match", hostport, want)
+		case ok && host != want:
+			t.Errorf("%s: want %s, have %s", hostport, want, host)
+		}
+	}
+}
+
+func TestHostWithPort(t *testing.T) {
+	h := newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: "text:200:a"}})
+	for _, host := range []string{"a.com", "a.com:8080", "b.com"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		h.ServeHTTP(rec, req)
+		want := http.StatusOK
+		if strings.HasPrefix(host, "b.com") {
+			want = http.StatusNotFound
+		}
+		if rec.Code != want {
+			t.Errorf("%s: want %d, have %d", host, want, rec.Code)
+		}
+	}
+}
+
+func TestEmptyHost(t *testing.T) {
+	entries := []Entry{{Hosts: []string{"a.com"}, Dest: "text:200:a"}}
+	for name, test := range map[string]struct {
+		options []HandlerOption
+		code    int
+		body    string
+	}{
+		"default":    {nil, http.StatusNotFound, ""},
+		"empty-host": {[]HandlerOption{WithEmptyHost("a.com")}, http.StatusOK, "a"},
+		"400":        {[]HandlerOption{WithRejectEmptyHost()}, http.StatusBadRequest, ""},
+	} {
+		h := newTestHandler(t, entries, test.options...)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = ""
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s: want %d, have %d", name, test.code, rec.Code)
+		}
+		if test.body != "" && rec.Body.String() != test.body {
+			t.Errorf("%s: want body %q, have %q", name, test.body, rec.Body.String())
+		}
+	}
+}
+
+// readFromRecorder records whether the body was written with ReadFrom, as
+// net/http's ResponseWriter does with sendfile.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestFileServerReadFrom(t *testing.T) {
+	dir := t.TempDir()
+	body := strings.Repeat("x", 4096)
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	headers := filepath.Join(t.TempDir(), "headers")
+	if err := os.WriteFile(headers, []byte("X-Frame-Options: DENY\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, []Entry{
+		{Hosts: []string{"a.com"}, Dest: dir},
+		{Hosts: []string{"b.com"}, Dest: dir, Cache: []CacheRule{{Pattern: "*", Value: "max-age=60"}}},
+		{Hosts: []string{"c.com"}, Dest: dir, HeadersFile: headers},
+	})
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest("GET", "/file.txt", nil)
+		req.Host = host
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != body {
+			t.Fatalf("%s: want 200 and the file, have %d and %d bytes", host, rec.Code, rec.Body.Len())
+		}
+		if !rec.readFrom {
+			t.Errorf("%s: want the file written with ReadFrom, have Write", host)
+		}
+	}
+}
+
+func TestSetCanary(t *testing.T) {
+	backend := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+	}
+	stable, canary := backend("stable"), backend("canary")
+	defer stable.Close()
+	defer canary.Close()
+	entries := []Entry{
+		{Hosts: []string{"a.com"}, Dest: stable.URL, Canary: &Canary{Dest: canary.URL, Percent: 0}},
+		{Hosts: []string{"b.com"}, Dest: stable.URL},
+	}
+	h := newTestHandler(t, entries)
+	get := func() string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "a.com"
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	if have := get(); have != "stable" {
+		t.Fatalf("configured 0%%: want stable, have %s", have)
+	}
+	if err := h.SetCanary("a.com", 100); err != nil {
+		t.Fatal(err)
+	}
+	if have := get(); have != "canary" {
+		t.Errorf("set to 100%%: want canary, have %s", have)
+	}
+	for host, percent := range map[string]float64{"b.com": 50, "c.com": 50, "a.com": 101} {
+		if err := h.SetCanary(host, percent); err == nil {
+			t.Errorf("%s at %v%%: want error, have none", host, percent)
+		}
+	}
+
+	// Reloading restores the configured percentage.
+	cfg, err := NewConfiguration(entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetConfiguration(cfg)
+	if have := get(); have != "stable" {
+		t.Errorf("reloaded: want stable, have %s", have)
+	}
+}
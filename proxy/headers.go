@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readHeaders reads a file of response headers, one per line, as
+// Name: value. Blank lines, and lines starting with #, are ignored. A header
+// may be given more than once, for several values.
+func readHeaders(filename string) (http.Header, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		header = http.Header{}
+		s      = bufio.NewScanner(skipBOM(f))
+	)
+	s.Buffer(nil, maxLineLength)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !validHeaderName(name) {
+			return nil, errors.Errorf("%s:%d: want Name: value", filename, n)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, s.Err()
+}
+
+// validHeaderName reports whether name is a valid HTTP header name: a
+// non-empty token, per RFC 9110.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setHeaders sets headers on every response, replacing any of the same name
+// set by next, e.g. from a backend.
+type setHeaders struct {
+	header http.Header
+	next   http.Handler
+}
+
+func (s *setHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.next.ServeHTTP(&headerWriter{ResponseWriter: w, header: s.header}, r)
+}
+
+func (s *setHeaders) check() {
+	check(s.next)
+}
+
+// headerWriter sets the headers when the response headers are written, so
+// they take precedence over any others.
+type headerWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		for name, values := range w.header {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the underlying ResponseWriter's sendfile, as in statusWriter.
+func (w *headerWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// prefixRoute serves requests whose path is prefix, or starts with prefix/.
+type prefixRoute struct {
+	prefix string
+	dest   string
+	http.Handler
+}
+
+// prefixRouter routes requests for a host by path prefix, stripping the prefix
+// before passing them on. The longest matching prefix wins; requests that
+// match no prefix go to the default target, or 404 if there isn't one.
+type prefixRouter struct {
+	routes []prefixRoute
+	dflt   Target
+}
+
+func newPrefixRouter(routes []prefixRoute, dflt Target) *prefixRouter {
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	if dflt.Handler == nil {
+		dflt = Target{Dest: "not found", Handler: http.NotFoundHandler()}
+	}
+	return &prefixRouter{routes: routes, dflt: dflt}
+}
+
+func (p *prefixRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range p.routes {
+		rest, ok := strings.CutPrefix(r.URL.Path, route.prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			continue
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		setBackend(r2, route.dest)
+		setPrefix(r2, route.prefix)
+		route.ServeHTTP(w, r2)
+		return
+	}
+	setBackend(r, p.dflt.Dest)
+	p.dflt.ServeHTTP(w, r)
+}
+
+// describe lists where each prefix is served from, for logging.
+func (p *prefixRouter) describe() string {
+	var s []string
+	for _, route := range p.routes {
+		s = append(s, route.prefix+" -> "+route.dest)
+	}
+	return strings.Join(append(s, "default -> "+p.dflt.Dest), ", ")
+}
+
+func (p *prefixRouter) check() {
+	for _, route := range p.routes {
+		check(route.Handler)
+	}
+	check(p.dflt.Handler)
+}
+
+// splitHostPrefix splits a host of the form host/prefix. The prefix has a
+// leading slash and no trailing slash, and is empty if there isn't one.
+func splitHostPrefix(src string) (host, prefix string) {
+	i := strings.Index(src, "/")
+	if i < 0 {
+		return src, ""
+	}
+	return src[:i], strings.TrimRight(src[i:], "/")
+}
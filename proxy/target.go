@@ -0,0 +1,682 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// describe returns a description of where the entry's hosts are served from,
+// for logging.
+func (e Entry) describe() string {
+	if e.Redirect != "" {
+		return "redirect " + e.Redirect
+	}
+	return e.Dest
+}
+
+// handler builds the HTTP handler for the entry: its target, behind any
+// authentication, response headers, and write timeout.
+func (e Entry) handler(transports *TransportPool, o loadOptions) (http.Handler, error) {
+	h, err := e.target(transports, o)
+	if err != nil {
+		return nil, err
+	}
+	if e.AuthFile != "" {
+		users, err := readHtpasswd(e.AuthFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "authfile")
+		}
+		realm, _ := splitHostPrefix(e.Hosts[0])
+		h = &basicAuth{realm: realm, users: users, next: h}
+	}
+	if e.HeadersFile != "" {
+		header, err := readHeaders(e.HeadersFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "headers-file")
+		}
+		h = &setHeaders{header: header, next: h}
+	}
+	if e.WriteTimeout != "" {
+		d, err := time.ParseDuration(e.WriteTimeout)
+		if err != nil || d < 0 {
+			return nil, errors.Errorf("write-timeout: invalid duration %q", e.WriteTimeout)
+		}
+		h = &writeTimeout{timeout: d, next: h}
+	}
+	return h, nil
+}
+
+// writeTimeout replaces the server's write timeout, if any, for requests it
+// serves: the response must be written within the timeout, or without any
+// limit if it's 0, e.g. for large downloads.
+type writeTimeout struct {
+	timeout time.Duration
+	next    http.Handler
+}
+
+func (t *writeTimeout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var deadline time.Time
+	if t.timeout > 0 {
+		deadline = time.Now().Add(t.timeout)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+		log.Printf("%s %s (%s) -> write-timeout not applied: %v", r.RemoteAddr, r.Host, r.URL.Path, err)
+	}
+	t.next.ServeHTTP(w, r)
+}
+
+func (t *writeTimeout) check() {
+	check(t.next)
+}
+
+// target builds the HTTP handler for the entry's destination.
+func (e Entry) target(transports *TransportPool, o loadOptions) (http.Handler, error) {
+	if e.Redirect != "" {
+		return e.canonicalRedirect()
+	}
+	if e.Dest == "" {
+		return nil, errors.New("missing destination")
+	}
+	if strings.HasPrefix(e.Dest, "text:") || strings.HasPrefix(e.Dest, "file:") {
+		return e.static()
+	}
+	if strings.HasPrefix(e.Dest, "redirect:") {
+		return e.redirect()
+	}
+	if fi, err := os.Stat(e.Dest); err == nil && fi.IsDir() && !isPort(e.Dest) {
+		var handler http.Handler = http.FileServer(http.Dir(e.Dest))
+		if e.SPA {
+			handler = spa(e.Dest, handler)
+		}
+		if len(e.Cache) > 0 {
+			for _, c := range e.Cache {
+				if !validCachePattern(c.Pattern) {
+					return nil, errors.Errorf("cache: invalid pattern %q", c.Pattern)
+				}
+			}
+			handler = cacheControl(e.Cache, handler)
+		}
+		if len(e.Replace) > 0 {
+			var oldnew []string
+			for _, r := range e.Replace {
+				if r.Old == "" {
+					return nil, errors.New("replace: old must not be empty")
+				}
+				oldnew = append(oldnew, r.Old, r.New)
+			}
+			handler = replaceHTML(strings.NewReplacer(oldnew...), handler)
+		}
+		return newDirCheck(e.Dest, o.retryAfter, handler), nil
+	}
+	var headerTimeout time.Duration
+	if e.HeaderTimeout != "" {
+		var err error
+		if headerTimeout, err = time.ParseDuration(e.HeaderTimeout); err != nil || headerTimeout <= 0 {
+			return nil, errors.Errorf("header-timeout: invalid duration %q", e.HeaderTimeout)
+		}
+	}
+	via, err := e.viaURL()
+	if err != nil {
+		return nil, errors.Wrap(err, "via")
+	}
+	u, err := backendURL(e.Dest, o)
+	if err != nil {
+		return nil, err
+	}
+	chunked, err := parseChunked(e.Chunked)
+	if err != nil {
+		return nil, errors.Wrap(err, "chunked")
+	}
+	proxy, err := e.reverseProxy(u, e.transport(u, transports, headerTimeout, via), o)
+	if err != nil {
+		return nil, err
+	}
+	if e.Canary == nil {
+		return chunkedBodies(chunked, proxy), nil
+	}
+	if e.Canary.Percent < 0 || e.Canary.Percent > 100 {
+		return nil, errors.Errorf("canary: invalid percentage %v", e.Canary.Percent)
+	}
+	cu, err := backendURL(e.Canary.Dest, o)
+	if err != nil {
+		return nil, errors.Wrap(err, "canary")
+	}
+	canary, err := e.reverseProxy(cu, e.transport(cu, transports, headerTimeout, via), o)
+	if err != nil {
+		return nil, errors.Wrap(err, "canary")
+	}
+	return chunkedBodies(chunked, &canarySplit{
+		stable:     proxy,
+		canary:     canary,
+		stableDest: e.Dest,
+		canaryDest: e.Canary.Dest,
+		percent:    e.Canary.Percent,
+		sticky:     e.Canary.Sticky,
+	}), nil
+}
+
+// transport returns the transport from the pool for the backend at u, with the
+// entry's settings. Hosts share a transport only if their settings are the
+// same.
+func (e Entry) transport(u *url.URL, transports *TransportPool, headerTimeout time.Duration, via *url.URL) *http.Transport {
+	var (
+		settings  string
+		configure []func(*http.Transport)
+	)
+	if e.SNI != "" && u.Scheme == "https" {
+		settings += " sni=" + e.SNI
+		configure = append(configure, func(t *http.Transport) {
+			if t.TLSClientConfig == nil {
+				t.TLSClientConfig = &tls.Config{}
+			}
+			t.TLSClientConfig.ServerName = e.SNI
+		})
+	}
+	if headerTimeout > 0 {
+		settings += " header-timeout=" + headerTimeout.String()
+		configure = append(configure, func(t *http.Transport) {
+			t.ResponseHeaderTimeout = headerTimeout
+		})
+	}
+	if e.DisableUpstreamKeepAlive {
+		settings += " disable-keepalive"
+		configure = append(configure, func(t *http.Transport) {
+			t.DisableKeepAlives = true
+		})
+	}
+	if via != nil {
+		settings += " via=" + via.String()
+		configure = append(configure, func(t *http.Transport) {
+			t.Proxy = http.ProxyURL(via)
+		})
+	}
+	return transports.get(u, settings, func(t *http.Transport) {
+		for _, f := range configure {
+			f(t)
+		}
+	})
+}
+
+// viaURL parses the via option, the URL of a proxy to connect to the backend
+// through. It returns nil if the option isn't set.
+func (e Entry) viaURL() (*url.URL, error) {
+	if e.Via == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(e.Via)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5":
+		return nil, errors.Errorf("%s: want an http://, https://, or socks5:// URL", u.Redacted())
+	case u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "":
+		return nil, errors.Errorf("%s: want scheme://[user:password@]host:port", u.Redacted())
+	}
+	return u, nil
+}
+
+// backendURL parses a destination that's either a port, on 127.0.0.1,
+// host:port, or an http:// or https:// URL, into the URL of the backend. Ports
+// and host:ports use https if the port is one of the HTTPS ports in o, and
+// http otherwise.
+func backendURL(dest string, o loadOptions) (*url.URL, error) {
+	if strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://") {
+		u, err := url.Parse(dest)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return nil, errors.Errorf("%s: want scheme://host[:port][/path]", dest)
+		}
+		return u, nil
+	}
+	scheme := func(port string) string {
+		if o.httpsPorts[port] {
+			return "https"
+		}
+		return "http"
+	}
+	if isPort(dest) {
+		return &url.URL{Scheme: scheme(dest), Host: net.JoinHostPort("127.0.0.1", dest)}, nil
+	}
+	if host, port, err := net.SplitHostPort(dest); err == nil && host != "" {
+		if !isPort(port) {
+			return nil, errors.Errorf("%s: invalid port", dest)
+		}
+		// JoinHostPort restores the brackets around IPv6 literals.
+		return &url.URL{Scheme: scheme(port), Host: net.JoinHostPort(host, port)}, nil
+	}
+	return nil, errors.Errorf("%s is not a port, host:port, URL, or directory", dest)
+}
+
+func isPort(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// canonicalRedirect returns a handler that permanently redirects requests to
+// the same URL on the canonical host given by the redirect option, preserving
+// the scheme, path, and query.
+func (e Entry) canonicalRedirect() (http.Handler, error) {
+	if e.Dest != "" {
+		return nil, errors.New("redirect can't be combined with a destination")
+	}
+	if strings.ContainsAny(e.Redirect, "/?#") {
+		return nil, errors.Errorf("redirect %s: want a host, e.g. example.com", e.Redirect)
+	}
+	for _, host := range e.Hosts {
+		if host == e.Redirect {
+			return nil, errors.Errorf("%s redirects to itself", host)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := url.URL{Scheme: "http", Host: e.Redirect, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	}), nil
+}
+
+// redirect returns a handler redirecting every request to the URL given by a
+// destination of the form redirect:URL, with status 301 or the redirect-status
+// option. With the preserve-path option, the request path and query are
+// appended to the URL.
+func (e Entry) redirect() (http.Handler, error) {
+	target, err := url.Parse(strings.TrimPrefix(e.Dest, "redirect:"))
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, errors.Errorf("%s: want redirect:scheme://host[/path]", e.Dest)
+	}
+	code := http.StatusMovedPermanently
+	if e.RedirectStatus != 0 {
+		switch code = e.RedirectStatus; code {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, errors.Errorf("redirect-status: %d isn't a redirect status", code)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := *target
+		if e.PreservePath {
+			u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+			u.RawPath = ""
+			switch {
+			case u.RawQuery == "":
+				u.RawQuery = r.URL.RawQuery
+			case r.URL.RawQuery != "":
+				u.RawQuery += "&" + r.URL.RawQuery
+			}
+		}
+		http.Redirect(w, r, u.String(), code)
+	}), nil
+}
+
+// static returns a handler serving a fixed response, given by a destination of
+// the form text:status:body, or file:status:path to read the body from a file.
+func (e Entry) static() (http.Handler, error) {
+	toks := strings.SplitN(e.Dest, ":", 3)
+	if len(toks) != 3 {
+		return nil, errors.Errorf("%s: want %s:status:...", e.Dest, toks[0])
+	}
+	code, err := strconv.Atoi(toks[1])
+	if err != nil || code < 100 || code > 999 {
+		return nil, errors.Errorf("%s: invalid status code", e.Dest)
+	}
+	body := []byte(toks[2])
+	if toks[0] == "file" {
+		if body, err = os.ReadFile(toks[2]); err != nil {
+			return nil, err
+		}
+	}
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(code)
+		w.Write(body)
+	}), nil
+}
+
+// reverseProxy returns a reverse proxy to u. Hop-by-hop headers (Connection,
+// Keep-Alive, Proxy-Authenticate, etc.) are always removed by httputil; any
+// headers in the strip-header option are removed in addition.
+func (e Entry) reverseProxy(u *url.URL, transport http.RoundTripper, o loadOptions) (http.Handler, error) {
+	var re *regexp.Regexp
+	if e.Rewrite != nil {
+		var err error
+		if re, err = regexp.Compile(e.Rewrite.Pattern); err != nil {
+			return nil, errors.Wrap(err, "rewrite")
+		}
+	}
+	var timeout time.Duration
+	if e.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(e.Timeout); err != nil || timeout <= 0 {
+			return nil, errors.Errorf("timeout: invalid duration %q", e.Timeout)
+		}
+	}
+	var idleTimeout time.Duration
+	if e.WebSocketIdleTimeout != "" {
+		var err error
+		if idleTimeout, err = time.ParseDuration(e.WebSocketIdleTimeout); err != nil || idleTimeout <= 0 {
+			return nil, errors.Errorf("websocket-idle-timeout: invalid duration %q", e.WebSocketIdleTimeout)
+		}
+	}
+	page, err := e.timeoutPage()
+	if err != nil {
+		return nil, errors.Wrap(err, "timeout-page")
+	}
+	var fallback http.Handler
+	if e.Fallback != "" {
+		if fi, err := os.Stat(e.Fallback); err != nil || !fi.IsDir() {
+			return nil, errors.Errorf("fallback: %s is not a directory", e.Fallback)
+		}
+		fallback = http.FileServer(http.Dir(e.Fallback))
+	}
+	allowed, err := parseStatusSet(e.AllowStatus)
+	if err != nil {
+		return nil, errors.Wrap(err, "allow-status")
+	}
+	authorization, err := e.upstreamAuthorization()
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream-auth")
+	}
+	if e.DebugBody < 0 {
+		return nil, errors.Errorf("debug-body: invalid size %d", e.DebugBody)
+	}
+	if e.GzipLevel != 0 && (e.GzipLevel < gzip.BestSpeed || e.GzipLevel > gzip.BestCompression) {
+		return nil, errors.Errorf("gzip-level: invalid level %d, want 1 to 9", e.GzipLevel)
+	}
+	for _, t := range e.NoGzip {
+		if _, params, err := mime.ParseMediaType(t); err != nil || len(params) > 0 {
+			return nil, errors.Errorf("nogzip: invalid content type %q", t)
+		}
+	}
+	if e.Buffer < 0 {
+		return nil, errors.Errorf("buffer: invalid size %d", e.Buffer)
+	}
+	for key, params := range map[string][]QueryParam{"add-query": e.AddQuery, "set-query": e.SetQuery} {
+		for _, p := range params {
+			if p.Name == "" {
+				return nil, errors.Errorf("%s: name must not be empty", key)
+			}
+		}
+	}
+	for _, c := range e.CookiePath {
+		if !strings.HasPrefix(c.Old, "/") || !strings.HasPrefix(c.New, "/") {
+			return nil, errors.Errorf("cookie-path: paths %q and %q must start with /", c.Old, c.New)
+		}
+	}
+	if e.DebugBody > 0 {
+		log.Printf("WARNING: logging request bodies to %s, for debugging only", u)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = transport
+	if o.debugHeaders {
+		proxy.Transport = &debugTransport{next: transport, redact: o.redact}
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		if re != nil {
+			r.URL.Path = re.ReplaceAllString(r.URL.Path, e.Rewrite.Replacement)
+			r.URL.RawPath = ""
+		}
+		if e.ForwardHost {
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		}
+		if e.ForwardClientPort {
+			// Not X-Forwarded-Port, which frameworks take to be the port the
+			// client connected to, and use in the URLs they generate.
+			if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				r.Header.Set("X-Forwarded-Client-Port", port)
+			}
+		}
+		director(r)
+		for _, name := range e.StripHeader {
+			r.Header.Del(name)
+		}
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		if e.DebugBody > 0 {
+			debugBody(r, e.DebugBody)
+		}
+		if len(e.AddQuery) > 0 || len(e.SetQuery) > 0 || len(e.StripQuery) > 0 {
+			q := r.URL.Query()
+			for _, name := range e.StripQuery {
+				q.Del(name)
+			}
+			for _, p := range e.SetQuery {
+				q.Set(p.Name, p.Value)
+			}
+			for _, p := range e.AddQuery {
+				q.Add(p.Name, p.Value)
+			}
+			r.URL.RawQuery = q.Encode()
+		}
+		if e.Via != "" && u.Scheme == "http" {
+			// The transport builds the absolute-form target it sends to the
+			// proxy from the Host header, so it's set here, keeping the
+			// client's Host.
+			r.URL.Opaque = "//" + r.URL.Host + r.URL.EscapedPath()
+		}
+	}
+	if len(e.StripResponseHeader) > 0 || allowed != nil || e.Gzip || e.Buffer > 0 || len(e.CookieDomain) > 0 || len(e.CookiePath) > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if allowed != nil && !allowed[resp.StatusCode] && resp.StatusCode != http.StatusSwitchingProtocols {
+				return disallowedStatus(resp.StatusCode)
+			}
+			for _, name := range e.StripResponseHeader {
+				resp.Header.Del(name)
+			}
+			if len(e.CookieDomain) > 0 || len(e.CookiePath) > 0 {
+				rewriteCookies(resp.Header, e.CookieDomain, e.CookiePath)
+			}
+			if e.Gzip {
+				gzipResponse(resp, e.GzipLevel, e.NoGzip)
+			}
+			if e.Buffer > 0 {
+				return bufferBody(resp, e.Buffer)
+			}
+			return nil
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("http: proxy error: %s %s: %v", u, errorClass(err), err)
+		var disallowed disallowedStatus
+		if fallback != nil && !errors.Is(err, context.Canceled) && !errors.As(err, &disallowed) {
+			// r is the outgoing request, so restore the original path.
+			r2 := r.Clone(r.Context())
+			r2.URL.Path, r2.URL.RawPath = r.Context().Value(originalPathKey{}).(string), ""
+			fallback.ServeHTTP(w, r2)
+			return
+		}
+		if !isTimeout(err) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if page == nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(page))
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write(page)
+	}
+	var handler http.Handler = proxy
+	if timeout > 0 {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isUpgrade(r) {
+				// The timeout would close the upgraded connection. The
+				// handshake is still limited by any header-timeout.
+				proxy.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			proxy.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	if idleTimeout > 0 {
+		handler = idleUpgrades(handler, idleTimeout)
+	}
+	if fallback != nil {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), originalPathKey{}, r.URL.Path)))
+		})
+	}
+	return handler, nil
+}
+
+// bufferBody reads the body of resp into memory, if it's at most max bytes,
+// so it's sent to the client with a Content-Length, in one go. Larger bodies
+// are streamed, after the bytes already read. Responses that don't have a
+// body, e.g. to HEAD requests, are left alone.
+func bufferBody(resp *http.Response, max int) error {
+	switch {
+	case resp.Request.Method == http.MethodHead:
+		return nil
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, int64(max)+1))
+	if err != nil {
+		resp.Body.Close()
+		return errors.Wrap(err, "buffering response")
+	}
+	if len(buf) > max {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	resp.ContentLength = int64(len(buf))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	resp.TransferEncoding = nil
+	return nil
+}
+
+// parseStatusSet parses a list of status codes, e.g. 200, and classes of
+// them, e.g. 2xx, to the set of codes. It returns nil for an empty list.
+func parseStatusSet(list []string) (map[int]bool, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	set := map[int]bool{}
+	for _, s := range list {
+		if len(s) == 3 && s[0] >= '1' && s[0] <= '5' && strings.ToLower(s[1:]) == "xx" {
+			first := int(s[0]-'0') * 100
+			for code := first; code < first+100; code++ {
+				set[code] = true
+			}
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, errors.Errorf("%q isn't a status code or class, e.g. 200 or 2xx", s)
+		}
+		set[code] = true
+	}
+	return set, nil
+}
+
+// isTimeout reports whether err is from the timeout option, or a network or
+// transport timeout, e.g. header-timeout.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &t) && t.Timeout())
+}
+
+// errorClass describes why a request to a backend failed, for the log, so
+// e.g. a backend that's down can be told apart from one that's slow.
+func errorClass(err error) string {
+	var op *net.OpError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled by client"
+	case isTimeout(err):
+		return "timed out"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused connection"
+	case errors.As(err, &op) && op.Op == "dial":
+		return "unreachable"
+	}
+	return "failed"
+}
+
+// disallowedStatus is the error for a backend response whose status isn't in
+// allow-status. It's the backend's error, not an outage, so it isn't served
+// from the fallback.
+type disallowedStatus int
+
+func (code disallowedStatus) Error() string {
+	return "status " + strconv.Itoa(int(code)) + " isn't in allow-status"
+}
+
+// originalPathKey is the context key for the request path before it's
+// rewritten, for serving the fallback directory.
+type originalPathKey struct{}
+
+// upstreamAuthorization returns the Authorization header for requests to the
+// backend, given by the upstream-auth option as user:password, or file:path
+// to read user:password from a file, or "" if there isn't one.
+func (e Entry) upstreamAuthorization() (string, error) {
+	credentials := e.UpstreamAuth
+	if credentials == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(credentials, "file:") {
+		buf, err := os.ReadFile(strings.TrimPrefix(credentials, "file:"))
+		if err != nil {
+			return "", err
+		}
+		credentials = strings.TrimSpace(string(buf))
+	}
+	if !strings.Contains(credentials, ":") {
+		return "", errors.New("want user:password or file:path")
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+}
+
+// timeoutPage returns the body of the 504 response for requests that exceed
+// the timeout, given by the timeout-page option as text:body or file:path, or
+// nil if there isn't one.
+func (e Entry) timeoutPage() ([]byte, error) {
+	switch {
+	case e.TimeoutPage == "":
+		return nil, nil
+	case strings.HasPrefix(e.TimeoutPage, "text:"):
+		return []byte(strings.TrimPrefix(e.TimeoutPage, "text:")), nil
+	case strings.HasPrefix(e.TimeoutPage, "file:"):
+		return os.ReadFile(strings.TrimPrefix(e.TimeoutPage, "file:"))
+	default:
+		return nil, errors.Errorf("%s: want text:body or file:path", e.TimeoutPage)
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// TransportPool keeps a transport, and so a pool of connections, per backend.
+// Hosts proxying to the same backend share its transport. When a config is
+// replaced, backends that are no longer referenced have their idle
+// connections closed; in-flight requests are unaffected.
+type TransportPool struct {
+	base *http.Transport
+
+	mtx        sync.Mutex
+	transports map[string]*http.Transport
+	backends   map[string]*url.URL
+	used       map[string]bool
+}
+
+// NewTransportPool returns a pool whose transports are clones of base.
+func NewTransportPool(base *http.Transport) *TransportPool {
+	return &TransportPool{
+		base:       base,
+		transports: map[string]*http.Transport{},
+		backends:   map[string]*url.URL{},
+		used:       map[string]bool{},
+	}
+}
+
+// reset is called before loading a config, to start tracking which
+// transports it uses.
+func (p *TransportPool) reset() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.used = map[string]bool{}
+}
+
+// get returns the transport for the backend at u, creating it if necessary,
+// and marks it as used by the config being loaded. If configure isn't nil,
+// it's called on a newly created transport, so settings must identify its
+// effect.
+func (p *TransportPool) get(u *url.URL, settings string, configure func(*http.Transport)) *http.Transport {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	key := u.String() + settings
+	t, ok := p.transports[key]
+	if !ok {
+		t = p.base.Clone()
+		if configure != nil {
+			configure(t)
+		}
+		p.transports[key] = t
+		p.backends[key] = u
+	}
+	p.used[key] = true
+	return t
+}
+
+// Prune should be called after a newly loaded configuration is in use. It
+// closes the idle connections of every transport that configuration doesn't
+// use, and forgets them.
+func (p *TransportPool) Prune() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for key, t := range p.transports {
+		if !p.used[key] {
+			log.Printf("closing idle connections to %s", p.backends[key])
+			t.CloseIdleConnections()
+			delete(p.transports, key)
+			delete(p.backends, key)
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections of every transport, so
+// subsequent requests open new ones. In-flight requests are unaffected.
+func (p *TransportPool) CloseIdleConnections() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// Warmup sends a HEAD request to the backend of every transport used by the
+// configuration loaded last, so each has a connection ready for the first
+// request, and logs the backends that can't be reached. It returns when
+// every request is done, or ctx is.
+func (p *TransportPool) Warmup(ctx context.Context) {
+	type backend struct {
+		u *url.URL
+		t *http.Transport
+	}
+	var backends []backend
+	p.mtx.Lock()
+	for key := range p.used {
+		backends = append(backends, backend{p.backends[key], p.transports[key]})
+	}
+	p.mtx.Unlock()
+
+	var (
+		wg          sync.WaitGroup
+		unreachable atomic.Int64
+	)
+	for _, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.u.String(), nil)
+			if err != nil {
+				return
+			}
+			resp, err := b.t.RoundTrip(req)
+			if err != nil {
+				log.Printf("warmup: %s is unreachable: %v", b.u, err)
+				unreachable.Add(1)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	log.Printf("warmup: %d of %d backends reachable", len(backends)-int(unreachable.Load()), len(backends))
+}
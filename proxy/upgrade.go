@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isUpgrade reports whether r asks to switch protocols, e.g. to WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idleUpgrades closes connections upgraded to another protocol, e.g.
+// WebSocket, once they've been idle for timeout. net/http clears the HTTP
+// deadlines of connections when they're hijacked, so otherwise they're only
+// closed by either end.
+func idleUpgrades(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isUpgrade(r) {
+			w = &upgradeWriter{ResponseWriter: w, idleTimeout: timeout}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// upgradeWriter wraps the connection in an idleConn when it's hijacked.
+type upgradeWriter struct {
+	http.ResponseWriter
+	idleTimeout time.Duration
+}
+
+func (w *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(w.idleTimeout))
+	return &idleConn{Conn: conn, timeout: w.idleTimeout}, brw, nil
+}
+
+func (w *upgradeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idleConn extends the deadline of the connection by timeout whenever data is
+// read or written, in either direction, so it's closed only once it's idle.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
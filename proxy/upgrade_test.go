@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoUpgradeServer returns a backend that switches every request to a
+// protocol echoing lines back.
+func newEchoUpgradeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+}
+
+// dialUpgrade opens an upgraded connection to a.com through the proxy.
+func dialUpgrade(t *testing.T, proxy *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, have %d", resp.StatusCode)
+	}
+	return conn, r
+}
+
+// echo sends a line over the upgraded connection, and returns the error, if
+// any, from reading it back.
+func echo(conn net.Conn, r *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err == nil && line != "ping\n" {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func TestUpgradeOutlivesTimeout(t *testing.T) {
+	backend := newEchoUpgradeServer(t)
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, Timeout: "100ms"}}))
+	defer proxy.Close()
+
+	conn, r := dialUpgrade(t, proxy)
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	if err := echo(conn, r); err != nil {
+		t.Errorf("after the timeout: %v", err)
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	backend := newEchoUpgradeServer(t)
+	defer backend.Close()
+	proxy := httptest.NewServer(newTestHandler(t, []Entry{{Hosts: []string{"a.com"}, Dest: backend.URL, WebSocketIdleTimeout: "300ms"}}))
+	defer proxy.Close()
+
+	conn, r := dialUpgrade(t, proxy)
+	defer conn.Close()
+	// Traffic keeps the connection open past the idle timeout.
+	for i := 0; i < 6; i++ {
+		if err := echo(conn, r); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if err := echo(conn, r); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("after idling: want the connection closed, have %v", err)
+	}
+}
@@ -12,6 +12,7 @@ if test (echo $VERSION | grep '^v')
 end
 
 set REV (git rev-parse --short HEAD)
+set DATE (date -u +%Y-%m-%dT%H:%M:%SZ)
 echo Tagging $REV as v$VERSION
 git tag --annotate v$VERSION -m "Release v$VERSION"
 echo Be sure to: git push --tags
@@ -25,6 +26,6 @@ for pair in linux/amd64 darwin/amd64
 	set GOARCH (echo $pair | cut -d'/' -f2)
 	set BIN    $DISTDIR/http-proxy-$VERSION-$GOOS-$GOARCH
 	echo $BIN
-	env GOOS=$GOOS GOARCH=$GOARCH go build -o $BIN -ldflags="-X main.version=$VERSION" github.com/peterbourgon/http-proxy
+	env GOOS=$GOOS GOARCH=$GOARCH go build -o $BIN -ldflags="-X main.version=$VERSION -X main.commit=$REV -X main.date=$DATE" github.com/peterbourgon/http-proxy
 end
 
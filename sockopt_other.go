@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
+
+func setBacklog(fd uintptr, backlog int) error {
+	return errors.New("setting the backlog is not supported on this platform")
+}
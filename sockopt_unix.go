@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+// setBacklog calls listen again on a listening socket, which updates its
+// backlog.
+func setBacklog(fd uintptr, backlog int) error {
+	return unix.Listen(int(fd), backlog)
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+func dialSyslog(dest string) (ops, access io.Writer, err error) {
+	return nil, nil, errors.New("syslog not supported on this platform")
+}
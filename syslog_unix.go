@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// dialSyslog connects to the syslog daemon given by dest: local, or
+// network:address, e.g. udp:10.0.0.1:514. It returns writers for operational
+// logs, at notice severity, and access logs, at info severity.
+func dialSyslog(dest string) (ops, access io.Writer, err error) {
+	var network, raddr string
+	if dest != "local" {
+		network, raddr, _ = strings.Cut(dest, ":")
+	}
+	o, err := syslog.Dial(network, raddr, syslog.LOG_NOTICE|syslog.LOG_DAEMON, "http-proxy")
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "http-proxy")
+	if err != nil {
+		o.Close()
+		return nil, nil, err
+	}
+	return o, a, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// The build, set by release.fish with e.g. -ldflags="-X main.version=1.2.3".
+// Builds without them get the commit and date recorded by the go command, if
+// they were built from a git checkout.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes the build, e.g. "1.2.3 (commit 2d9c625, built
+// 2026-10-14T12:00:00Z)".
+func versionString() string {
+	commit, date := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, date)
+}